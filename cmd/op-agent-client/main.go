@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strings"
 
 	opagent "github.com/kossnocorp/op-agent"
 	"github.com/kossnocorp/op-agent/internal"
@@ -25,10 +26,26 @@ func executeOpCommand(args []string, quiet bool) {
 		os.Exit(1)
 	}
 
-	url := internal.GetAgentURL(inContainer(), internal.AgentCommandOp)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	req, err := newAgentRequest(http.MethodPost, internal.AgentCommandOp, jsonData)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error connecting to op-agent at %s: %v\n", url, err)
+		fmt.Fprintf(os.Stderr, "Error creating request: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := authorizeRequest(req, jsonData); err != nil {
+		fmt.Fprintf(os.Stderr, "Error authorizing request: %v\n", err)
+		os.Exit(1)
+	}
+
+	client, err := internal.NewAgentClient(inContainer())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring agent connection: %v\n", err)
+		os.Exit(1)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to op-agent at %s: %v\n", internal.GetAgentAddress(inContainer()), err)
 		os.Exit(1)
 	}
 	defer resp.Body.Close()
@@ -40,7 +57,7 @@ func executeOpCommand(args []string, quiet bool) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		fmt.Fprintf(os.Stderr, "Agent returned error %d: %s\n", resp.StatusCode, string(body))
+		fmt.Fprintf(os.Stderr, "Error: %v\n", agentError(resp.StatusCode, body))
 		os.Exit(1)
 	}
 
@@ -65,7 +82,7 @@ func main() {
 	var quietFlag bool
 
 	rootCmd := &cobra.Command{
-		Use:                "op-agent-client [flags] op [command...]",
+		Use:                "op-agent-client [flags] op [command...] | pair CODE [--name NAME]",
 		Short:              "1Password CLI agent client",
 		Long:               "op-agent-client connects to op-agent server to execute 1Password CLI commands.",
 		DisableFlagParsing: true, // Parse flags manually to avoid conflicts with 'op' command flags
@@ -101,6 +118,14 @@ func main() {
 				}
 			}
 
+			if opIndex == -1 && len(args) > 0 && args[0] == "pair" {
+				if err := pairClient(args[1:]); err != nil {
+					fmt.Fprintf(os.Stderr, "Pairing failed: %v\n", err)
+					os.Exit(1)
+				}
+				return
+			}
+
 			// Fall back to help if op is not found and we did't handle any other flags.
 			if opIndex == -1 {
 				cmd.Help()
@@ -120,13 +145,36 @@ func main() {
 }
 
 func checkHandshake(quiet bool) error {
-	resp, err := http.Get(internal.GetAgentURL(inContainer(), internal.AgentCommandHandshake))
+	req, err := newAgentRequest(http.MethodGet, internal.AgentCommandHandshake, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	if err := authorizeRequest(req, nil); err != nil {
+		return err
+	}
+
+	client, err := internal.NewAgentClient(inContainer())
+	if err != nil {
+		return err
+	}
 
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to connect to op-agent: %v", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("op-agent rejected the request, pair the client with `op-agent-client pair CODE` or set %s or %s to the host's ~/.config/op-agent/%s", internal.AgentTokenEnvName, internal.AgentTokenFileEnvName, internal.TokenFileName)
+	}
+
+	if resp.StatusCode == http.StatusForbidden {
+		var errResp internal.ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return forbiddenError(errResp.Reason)
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("handshake failed with status %d", resp.StatusCode)
 	}
@@ -147,6 +195,146 @@ func checkHandshake(quiet bool) error {
 	return nil
 }
 
+// Explains why the agent rejected the request, with the way to fix it.
+func forbiddenError(reason internal.DenialReason) error {
+	switch reason {
+	case internal.DenialReasonSourceNotAllowed:
+		return fmt.Errorf("op-agent doesn't allow requests from this network, start it with --allow to add the network")
+	case internal.DenialReasonInvalidHost:
+		return fmt.Errorf("op-agent doesn't accept the host name in %s, use an IP address, localhost, host.docker.internal, the host's name or the --listen host", internal.AgentHostEnvName)
+	case internal.DenialReasonBrowserOrigin, internal.DenialReasonBrowserFetch, internal.DenialReasonMissingRequestHeader:
+		return fmt.Errorf("op-agent rejected the request as coming from a browser (%s), make sure no proxy adds or strips headers and that op-agent-client is up to date", reason)
+	case "":
+		return fmt.Errorf("op-agent rejected the request")
+	}
+	return fmt.Errorf("op-agent rejected the request: %s", reason)
+}
+
+// Converts the agent error response into an error, falling back to the raw
+// body for responses that aren't structured.
+func agentError(status int, body []byte) error {
+	var errResp internal.ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error != "" {
+		return fmt.Errorf("agent returned error %d: %s (%s)", status, errResp.Error, errResp.Code)
+	}
+	return fmt.Errorf("agent returned error %d: %s", status, strings.TrimSpace(string(body)))
+}
+
+// Creates a request to the agent with the headers it requires.
+func newAgentRequest(method string, command internal.AgentCommand, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, internal.GetAgentURL(inContainer(), command), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set(internal.RequestHeader, "op-agent-client")
+	internal.DetectProject().SetHeaders(req)
+
+	if inContainer() {
+		if containerID := internal.GetContainerID(); containerID != "" {
+			req.Header.Set(internal.ContainerIDHeader, containerID)
+		}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return req, nil
+}
+
+// Signs the request when the client is paired or adds the shared token otherwise.
+func authorizeRequest(req *http.Request, body []byte) error {
+	identity, err := internal.LoadClientIdentity()
+	if err != nil {
+		return err
+	}
+
+	if identity != nil {
+		return identity.SignRequest(req, body)
+	}
+
+	token, err := internal.GetAgentToken()
+	if err != nil {
+		return err
+	}
+	internal.SetAuthHeader(req, token)
+
+	return nil
+}
+
+func pairClient(args []string) error {
+	var code, name string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--name" && i+1 < len(args):
+			name = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], "--name="):
+			name = strings.TrimPrefix(args[i], "--name=")
+		case code == "":
+			code = args[i]
+		default:
+			return fmt.Errorf("unexpected argument %q", args[i])
+		}
+	}
+
+	if code == "" {
+		return fmt.Errorf("missing pairing code, run `op-agent pair` on the host to get one")
+	}
+
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+
+	privateKey, publicKey, err := internal.GenerateClientKey()
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := json.Marshal(internal.PairRequest{Code: code, Name: name, PublicKey: publicKey})
+	if err != nil {
+		return fmt.Errorf("failed to encode pairing request: %v", err)
+	}
+
+	client, err := internal.NewAgentClient(inContainer())
+	if err != nil {
+		return err
+	}
+
+	req, err := newAgentRequest(http.MethodPost, internal.AgentCommandPair, jsonData)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to op-agent at %s: %v", internal.GetAgentAddress(inContainer()), err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return agentError(resp.StatusCode, body)
+	}
+
+	var pairResp internal.PairResponse
+	if err := json.Unmarshal(body, &pairResp); err != nil {
+		return fmt.Errorf("invalid pairing response: %v", err)
+	}
+
+	identity := internal.ClientIdentity{ID: pairResp.ID, PrivateKey: privateKey}
+	if err := internal.SaveClientIdentity(&identity); err != nil {
+		return err
+	}
+
+	fmt.Printf("🟢 Paired as %s (%s)\n", name, pairResp.ID)
+	return nil
+}
+
 func inContainer() bool {
 	if _, err := os.Stat("/.dockerenv"); err == nil {
 		return true
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kossnocorp/op-agent/internal"
+	"github.com/spf13/cobra"
+)
+
+func approvalsCommand() *cobra.Command {
+	approvalsCmd := &cobra.Command{
+		Use:   "approvals",
+		Short: "Manage approved and denied commands",
+	}
+
+	approvalsCmd.AddCommand(approvalsListCommand())
+	approvalsCmd.AddCommand(approvalsRevokeCommand())
+	approvalsCmd.AddCommand(approvalsEditCommand())
+	approvalsCmd.AddCommand(approvalsPruneCommand())
+
+	return approvalsCmd
+}
+
+// Rule as printed by `approvals list --json`. Unlike the config, rules are
+// always objects with the list and index to refer to them.
+type ruleView struct {
+	List       internal.RuleList `json:"list"`
+	Index      int               `json:"index"`
+	Command    string            `json:"command"`
+	Args       []string          `json:"args"`
+	Pattern    bool              `json:"pattern"`
+	Client     internal.Caller   `json:"client,omitempty"`
+	Project    string            `json:"project,omitempty"`
+	ExpiresAt  string            `json:"expires_at,omitempty"`
+	MaxUses    int               `json:"max_uses,omitempty"`
+	Uses       int               `json:"uses"`
+	LastUsedAt string            `json:"last_used_at,omitempty"`
+	CreatedAt  string            `json:"created_at,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	Origin     internal.Caller   `json:"origin,omitempty"`
+	Active     bool              `json:"active"`
+}
+
+// Filters of `approvals list`.
+type ruleFilter struct {
+	client  string
+	project string
+	match   string
+}
+
+func (f ruleFilter) matches(rule *internal.CommandRule) bool {
+	if f.client != "" && string(rule.Client) != f.client {
+		return false
+	}
+	if f.project != "" && rule.Project != f.project {
+		return false
+	}
+	if f.match != "" && !strings.Contains("op "+internal.FormatArgs(rule.Args), f.match) {
+		return false
+	}
+	return true
+}
+
+func approvalsListCommand() *cobra.Command {
+	var approvedOnly, deniedOnly, asJSON bool
+	var filter ruleFilter
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List approved and denied commands with their remaining lifetime",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			config := loadConfigOrExit()
+
+			lists := []internal.RuleList{internal.RuleListApproved, internal.RuleListDenied}
+			if approvedOnly && !deniedOnly {
+				lists = []internal.RuleList{internal.RuleListApproved}
+			} else if deniedOnly && !approvedOnly {
+				lists = []internal.RuleList{internal.RuleListDenied}
+			}
+
+			now := time.Now()
+			views := []ruleView{}
+			for _, list := range lists {
+				for i, rule := range config.Rules(list) {
+					if filter.matches(&rule) {
+						views = append(views, newRuleView(list, i+1, rule, now))
+					}
+				}
+			}
+
+			if asJSON {
+				data, err := json.MarshalIndent(views, "", "  ")
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error marshaling rules: %v\n", err)
+					os.Exit(1)
+				}
+				fmt.Printf("%s\n", data)
+				return
+			}
+
+			if len(views) == 0 {
+				fmt.Printf("No matching approved or denied commands\n")
+				return
+			}
+
+			for _, list := range lists {
+				printRules(config, list, views, now)
+			}
+		},
+	}
+
+	listCmd.Flags().BoolVar(&approvedOnly, "approved", false, "List only approved commands")
+	listCmd.Flags().BoolVar(&deniedOnly, "denied", false, "List only denied commands")
+	listCmd.Flags().StringVar(&filter.client, "client", "", "List only rules scoped to the client, i.e., container:ID")
+	listCmd.Flags().StringVar(&filter.project, "project", "", "List only rules scoped to the project")
+	listCmd.Flags().StringVar(&filter.match, "match", "", "List only rules whose command contains the text")
+	listCmd.Flags().BoolVar(&asJSON, "json", false, "Print the rules as JSON")
+
+	return listCmd
+}
+
+func approvalsRevokeCommand() *cobra.Command {
+	var denied, pattern bool
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke [--denied] INDEX... | revoke [--denied] [--pattern] op [command...]",
+		Short: "Remove approved or denied commands by index or command",
+		Long: `Remove approved (or, with --denied, denied) commands by the index shown by
+'op-agent approvals list', or by the command in the same syntax as approve.
+Removing by command drops every rule with the same arguments regardless of
+its client or project scope, i.e.:
+
+  op-agent approvals revoke 2 5
+  op-agent approvals revoke --pattern op read 'op://dev/*/password'`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			list := ruleList(denied)
+
+			var rule *internal.CommandRule
+			var indices []int
+			if args[0] == "op" {
+				byCommand, err := ruleOptions{pattern: pattern}.newRule(args[1:])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					os.Exit(1)
+				}
+				rule = &byCommand
+			} else {
+				var err error
+				if indices, err = parseIndices(args); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					os.Exit(1)
+				}
+			}
+
+			var removed []internal.CommandRule
+			updateConfigOrExit(func(config *internal.Config) error {
+				if rule == nil {
+					var err error
+					removed, err = config.RemoveRulesAt(list, indices)
+					return err
+				}
+
+				removed = config.RemoveEqualRules(list, *rule)
+				if len(removed) == 0 {
+					return fmt.Errorf("no %s rule for %s", list, rule.String())
+				}
+				return nil
+			})
+
+			for _, rule := range removed {
+				fmt.Printf("🔴 Rule revoked: %s\n", rule.String())
+			}
+		},
+	}
+
+	// Stop at the first argument, so the op command flags aren't parsed
+	revokeCmd.Flags().SetInterspersed(false)
+	revokeCmd.Flags().BoolVar(&denied, "denied", false, "Revoke denied commands instead of approved")
+	revokeCmd.Flags().BoolVar(&pattern, "pattern", false, "Match the command as a pattern rule")
+
+	return revokeCmd
+}
+
+func approvalsEditCommand() *cobra.Command {
+	var denied, pattern, noExpiry, resetUses, noClient, noProject bool
+	var expires, client, project string
+	var maxUses int
+
+	editCmd := &cobra.Command{
+		Use:   "edit INDEX [flags] [-- op command...]",
+		Short: "Change the command, scope or limits of an approved or denied command",
+		Long: `Change the approved (or, with --denied, denied) command by the index shown by
+'op-agent approvals list'. The command itself can be replaced after --, i.e.:
+
+  op-agent approvals edit 3 --expires 7d --no-client
+  op-agent approvals edit 3 --pattern -- op read 'op://dev/*/password'
+
+The edited rule is validated before saving.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			list := ruleList(denied)
+
+			indexArgs, opArgs := args, []string(nil)
+			if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+				indexArgs, opArgs = args[:dash], args[dash:]
+			}
+			if len(indexArgs) != 1 {
+				fmt.Fprintf(os.Stderr, "Error: Expected a single index, use -- before the op command\n")
+				os.Exit(1)
+			}
+
+			indices, err := parseIndices(indexArgs)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			// Parse the changes before locking the config
+			flags := cmd.Flags()
+			var replacement *internal.CommandRule
+			if opArgs != nil {
+				if len(opArgs) < 2 || opArgs[0] != "op" {
+					fmt.Fprintf(os.Stderr, "Error: Command must start with 'op'\n")
+					os.Exit(1)
+				}
+				rule, err := ruleOptions{pattern: pattern}.newRule(opArgs[1:])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					os.Exit(1)
+				}
+				replacement = &rule
+			} else if flags.Changed("pattern") {
+				fmt.Fprintf(os.Stderr, "Error: --pattern applies only to a replacement command after --\n")
+				os.Exit(1)
+			}
+
+			var expiresAt time.Time
+			if flags.Changed("expires") {
+				duration, err := internal.ParseDuration(expires)
+				if err != nil || duration == 0 {
+					fmt.Fprintf(os.Stderr, "Error: Invalid --expires value %s, expected a duration like 1h or 7d\n", expires)
+					os.Exit(1)
+				}
+				expiresAt = time.Now().Add(duration)
+			}
+
+			if flags.Changed("max-uses") && list == internal.RuleListDenied && maxUses != 0 {
+				fmt.Fprintf(os.Stderr, "Error: --max-uses applies only to approvals\n")
+				os.Exit(1)
+			}
+
+			var caller internal.Caller
+			if flags.Changed("client") {
+				if caller, err = internal.ParseCaller(client); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					os.Exit(1)
+				}
+			}
+
+			var rule internal.CommandRule
+			updateConfigOrExit(func(config *internal.Config) error {
+				existing, err := config.RuleAt(list, indices[0])
+				if err != nil {
+					return err
+				}
+				rule = *existing
+
+				if replacement != nil {
+					rule.Args, rule.Pattern = replacement.Args, replacement.Pattern
+				}
+
+				switch {
+				case noExpiry:
+					rule.ExpiresAt = ""
+				case !expiresAt.IsZero():
+					rule.SetExpiration(expiresAt)
+				}
+
+				if flags.Changed("max-uses") {
+					rule.MaxUses = maxUses
+				}
+				if resetUses {
+					rule.Uses = 0
+				}
+
+				switch {
+				case noClient:
+					rule.Client = ""
+				case caller != "":
+					rule.Client = caller
+				}
+
+				switch {
+				case noProject:
+					rule.Project = ""
+				case flags.Changed("project"):
+					rule.Project = project
+				}
+
+				if err := internal.ValidateRule(rule); err != nil {
+					return fmt.Errorf("invalid rule: %v", err)
+				}
+
+				*existing = rule
+				return nil
+			})
+
+			fmt.Printf("🟡 Rule updated: #%d %s", indices[0], rule.String())
+			if status := ruleStatus(&rule, time.Now()); status != "" {
+				fmt.Printf("  (%s)", status)
+			}
+			fmt.Printf("\n")
+		},
+	}
+
+	editCmd.Flags().BoolVar(&denied, "denied", false, "Edit a denied command instead of approved")
+	editCmd.Flags().BoolVar(&pattern, "pattern", false, "Treat the replacement command as a pattern rule")
+	editCmd.Flags().StringVar(&expires, "expires", "", "Expire the rule after the duration from now, i.e., 1h or 7d")
+	editCmd.Flags().BoolVar(&noExpiry, "no-expiry", false, "Remove the expiration")
+	editCmd.Flags().IntVar(&maxUses, "max-uses", 0, "Limit the number of uses, 0 removes the limit")
+	editCmd.Flags().BoolVar(&resetUses, "reset-uses", false, "Reset the use count")
+	editCmd.Flags().StringVar(&client, "client", "", "Scope the rule to the client, i.e., container:ID")
+	editCmd.Flags().BoolVar(&noClient, "no-client", false, "Apply the rule to every client")
+	editCmd.Flags().StringVar(&project, "project", "", "Scope the rule to the project")
+	editCmd.Flags().BoolVar(&noProject, "no-project", false, "Apply the rule to every project")
+	editCmd.MarkFlagsMutuallyExclusive("expires", "no-expiry")
+	editCmd.MarkFlagsMutuallyExclusive("client", "no-client")
+	editCmd.MarkFlagsMutuallyExclusive("project", "no-project")
+
+	return editCmd
+}
+
+func approvalsPruneCommand() *cobra.Command {
+	var unusedFor string
+	var dryRun bool
+
+	pruneCmd := &cobra.Command{
+		Use:   "prune --unused-for DURATION",
+		Short: "Remove approvals that weren't used for the duration",
+		Long: `Remove approvals that weren't used for the duration, i.e., 30d. Approvals
+that were never used count from when they were added. Approvals without
+either time, added before usage tracking, are kept.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			duration, err := internal.ParseDuration(unusedFor)
+			if err != nil || duration == 0 {
+				fmt.Fprintf(os.Stderr, "Error: Invalid --unused-for value %s, expected a duration like 30d\n", unusedFor)
+				os.Exit(1)
+			}
+
+			var removed []internal.CommandRule
+			if dryRun {
+				removed = loadConfigOrExit().PruneUnusedApprovals(time.Now(), duration)
+			} else {
+				updateConfigOrExit(func(config *internal.Config) error {
+					removed = config.PruneUnusedApprovals(time.Now(), duration)
+					return nil
+				})
+			}
+
+			if len(removed) == 0 {
+				fmt.Printf("No approvals unused for %s\n", unusedFor)
+				return
+			}
+
+			verb := "Pruned"
+			if dryRun {
+				verb = "Would prune"
+			}
+			for _, rule := range removed {
+				var status []string
+				if details := ruleStatus(&rule, time.Now()); details != "" {
+					status = append(status, details)
+				}
+				if _, ok := rule.LastUsed(); !ok {
+					status = append(status, "never used")
+				}
+				fmt.Printf("🔴 %s: %s  (%s)\n", verb, rule.String(), strings.Join(status, ", "))
+			}
+		},
+	}
+
+	pruneCmd.Flags().StringVar(&unusedFor, "unused-for", "", "Remove approvals unused for the duration, i.e., 30d")
+	pruneCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the approvals to prune without removing them")
+	pruneCmd.MarkFlagRequired("unused-for")
+
+	return pruneCmd
+}
+
+func newRuleView(list internal.RuleList, index int, rule internal.CommandRule, now time.Time) ruleView {
+	return ruleView{
+		List:       list,
+		Index:      index,
+		Command:    "op " + internal.FormatArgs(rule.Args),
+		Args:       rule.Args,
+		Pattern:    rule.Pattern,
+		Client:     rule.Client,
+		Project:    rule.Project,
+		ExpiresAt:  rule.ExpiresAt,
+		MaxUses:    rule.MaxUses,
+		Uses:       rule.Uses,
+		LastUsedAt: rule.LastUsedAt,
+		CreatedAt:  rule.CreatedAt,
+		Source:     string(rule.Source),
+		Origin:     rule.Origin,
+		Active:     rule.Active(now),
+	}
+}
+
+func printRules(config *internal.Config, list internal.RuleList, views []ruleView, now time.Time) {
+	title := "🟢 Approved"
+	if list == internal.RuleListDenied {
+		title = "🔴 Denied"
+	}
+
+	printed := false
+	for _, view := range views {
+		if view.List != list {
+			continue
+		}
+		if !printed {
+			fmt.Printf("%s:\n\n", title)
+			printed = true
+		}
+
+		rule, _ := config.RuleAt(list, view.Index)
+		fmt.Printf("  %d. %s", view.Index, rule.String())
+		if status := ruleStatus(rule, now); status != "" {
+			fmt.Printf("  (%s)", status)
+		}
+		fmt.Printf("\n")
+		if provenance := ruleProvenance(rule); provenance != "" {
+			fmt.Printf("     %s\n", provenance)
+		}
+	}
+	if printed {
+		fmt.Printf("\n")
+	}
+}
+
+// Describes the remaining lifetime and usage of the rule, i.e., `expires in
+// 59m, 2 of 5 uses left, last used 3d ago`. Returns an empty string for
+// permanent rules that were never used.
+func ruleStatus(rule *internal.CommandRule, now time.Time) string {
+	var parts []string
+
+	if rule.ExpiresAt != "" {
+		if expiresAt, ok := rule.Expiration(); !ok {
+			parts = append(parts, "invalid expiration "+rule.ExpiresAt)
+		} else if remaining := expiresAt.Sub(now); remaining > 0 {
+			parts = append(parts, "expires in "+formatRemaining(remaining))
+		} else {
+			parts = append(parts, "expired")
+		}
+	}
+
+	if rule.MaxUses > 0 {
+		parts = append(parts, fmt.Sprintf("%d of %d uses left", max(rule.MaxUses-rule.Uses, 0), rule.MaxUses))
+	} else if rule.Uses == 1 {
+		parts = append(parts, "used once")
+	} else if rule.Uses > 1 {
+		parts = append(parts, fmt.Sprintf("used %d times", rule.Uses))
+	}
+
+	if lastUsedAt, ok := rule.LastUsed(); ok {
+		parts = append(parts, "last used "+formatRemaining(now.Sub(lastUsedAt))+" ago")
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// Describes how the rule was added, i.e., `added 2025-09-01 14:03 via
+// interactive-always from container:4f2a9c1e8b7d`.
+func ruleProvenance(rule *internal.CommandRule) string {
+	var parts []string
+	if createdAt, ok := rule.Created(); ok {
+		parts = append(parts, "added "+createdAt.Local().Format("2006-01-02 15:04"))
+	}
+	if rule.Source != "" {
+		parts = append(parts, "via "+string(rule.Source))
+	}
+	if rule.Origin != "" {
+		parts = append(parts, "from "+rule.Origin.Short())
+	}
+	return strings.Join(parts, " ")
+}
+
+// Formats the duration with the two largest units, i.e., `2d 3h` or `59m 10s`.
+func formatRemaining(d time.Duration) string {
+	d = d.Round(time.Second)
+	days := d / (24 * time.Hour)
+	hours := (d % (24 * time.Hour)) / time.Hour
+	minutes := (d % time.Hour) / time.Minute
+	seconds := (d % time.Minute) / time.Second
+
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	case minutes > 0:
+		return fmt.Sprintf("%dm %ds", minutes, seconds)
+	default:
+		return fmt.Sprintf("%ds", seconds)
+	}
+}
+
+func ruleList(denied bool) internal.RuleList {
+	if denied {
+		return internal.RuleListDenied
+	}
+	return internal.RuleListApproved
+}
+
+func parseIndices(args []string) ([]int, error) {
+	indices := make([]int, 0, len(args))
+	for _, arg := range args {
+		index, err := strconv.Atoi(arg)
+		if err != nil || index < 1 {
+			return nil, fmt.Errorf("invalid index %s, expected a number from 'op-agent approvals list'", arg)
+		}
+		indices = append(indices, index)
+	}
+	return indices, nil
+}
+
+func loadConfigOrExit() *internal.Config {
+	config, err := internal.LoadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	return config
+}
+
+// Updates the config under the lock, exiting with the error of the update.
+func updateConfigOrExit(update func(config *internal.Config) error) {
+	if err := internal.UpdateConfig(update); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
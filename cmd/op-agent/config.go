@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kossnocorp/op-agent/internal"
+	"github.com/spf13/cobra"
+)
+
+func configCommand() *cobra.Command {
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the op-agent config",
+	}
+
+	var effective bool
+
+	showCmd := &cobra.Command{
+		Use:   "show",
+		Short: "Print the user config or, with --effective, the config merged with the system policy",
+		Long: `Print the user config. With --effective, print the config merged with the
+system policy, in the order rules are evaluated:
+
+  1. System deny rules, which can't be overridden
+  2. User deny rules
+  3. User approvals, then system approvals
+
+Limits are the user limits capped by the system policy.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := internal.LoadConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+				os.Exit(1)
+			}
+
+			var value any = config
+			if effective {
+				value = config.Effective()
+			}
+
+			data, err := json.MarshalIndent(value, "", "  ")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error marshaling config: %v\n", err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("%s\n", data)
+		},
+	}
+
+	showCmd.Flags().BoolVar(&effective, "effective", false, "Merge the system policy into the output")
+
+	validateCmd := &cobra.Command{
+		Use:   "validate [FILE]",
+		Short: "Check the config file for errors",
+		Long: `Check the config file, or FILE if given, for JSON and rule errors, printing
+each with its line and column. Configs stored by older versions are checked
+to migrate, as they are upgraded on the next load.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			path := ""
+			if len(args) > 0 {
+				path = args[0]
+			} else {
+				configPath, err := internal.GetConfigPath()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					os.Exit(1)
+				}
+				path = configPath
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading config: %v\n", err)
+				os.Exit(1)
+			}
+
+			issues := internal.ValidateConfig(data)
+			if len(issues) > 0 {
+				for _, issue := range issues {
+					if issue.Line == 0 {
+						fmt.Fprintf(os.Stderr, "%s: %s\n", path, issue)
+					} else {
+						fmt.Fprintf(os.Stderr, "%s:%s\n", path, issue)
+					}
+				}
+				os.Exit(1)
+			}
+
+			fmt.Printf("🟢 %s is valid\n", path)
+		},
+	}
+
+	var disable bool
+
+	protectCmd := &cobra.Command{
+		Use:   "protect",
+		Short: "Protect the config from changes made outside op-agent with an HMAC",
+		Long: `Sign the config with an HMAC using a key kept outside the config directory,
+so approvals added by a container with write access to the config are
+refused. Run it again to accept changes made by hand after reviewing them,
+or with --disable to remove the protection.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			keyPath, err := internal.GetIntegrityKeyPath()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			if disable {
+				if err := internal.UnprotectConfig(); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					os.Exit(1)
+				}
+				fmt.Printf("🟡 Config protection disabled\n")
+				return
+			}
+
+			if err := internal.ProtectConfig(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("🔒 Config signed with the key in %s\n", keyPath)
+		},
+	}
+
+	protectCmd.Flags().BoolVar(&disable, "disable", false, "Remove the key and the HMAC")
+
+	configCmd.AddCommand(showCmd)
+	configCmd.AddCommand(validateCmd)
+	configCmd.AddCommand(protectCmd)
+
+	return configCmd
+}
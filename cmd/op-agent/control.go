@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kossnocorp/op-agent/internal"
+	"github.com/spf13/cobra"
+)
+
+// Keys of the prompt options by the answer name used by the control channel.
+var answerKeys = map[string]byte{
+	"once":       'o',
+	"hour":       'h',
+	"session":    's',
+	"always":     'a',
+	"project":    'p',
+	"everywhere": 'e',
+	"never":      'n',
+	"no":         0,
+}
+
+// How often `op-agent pending` checks for new requests.
+const pendingPollInterval = time.Second
+
+// PID of the op-agent to connect to, set by `op-agent pending --pid`.
+var pendingPID int
+
+// Serves the control channel for `op-agent pending` on the control socket,
+// accessible only by the current user.
+func startControlServer(queue *promptQueue) (net.Listener, error) {
+	path, err := internal.GetControlSocketPath(os.Getpid())
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := internal.ListenUnixSocket(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(internal.ControlPathPending, func(w http.ResponseWriter, r *http.Request) {
+		handlePending(w, r, queue)
+	})
+	mux.HandleFunc(internal.ControlPathAnswer, func(w http.ResponseWriter, r *http.Request) {
+		handleAnswer(w, r, queue)
+	})
+
+	go http.Serve(listener, mux)
+
+	return listener, nil
+}
+
+func handlePending(w http.ResponseWriter, r *http.Request, queue *promptQueue) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, internal.ErrorCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(queue.list())
+}
+
+func handleAnswer(w http.ResponseWriter, r *http.Request, queue *promptQueue) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, internal.ErrorCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var answer internal.PendingAnswer
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, internal.DefaultMaxBodyBytes)).Decode(&answer); err != nil {
+		writeError(w, http.StatusBadRequest, internal.ErrorCodeInvalidJSON, "invalid JSON, expected an answer object")
+		return
+	}
+
+	key, ok := answerKeys[answer.Answer]
+	if !ok {
+		writeError(w, http.StatusBadRequest, internal.ErrorCodeInvalidRequest, fmt.Sprintf("invalid answer %s", internal.QuoteArg(answer.Answer)))
+		return
+	}
+
+	if answer.Answer == "project" {
+		request, ok := queue.find(answer.ID)
+		if ok && projectOption(request) == "" {
+			writeError(w, http.StatusBadRequest, internal.ErrorCodeInvalidRequest, "the request has no project to approve it for")
+			return
+		}
+	}
+
+	if !queue.resolve(answer.ID, promptAnswer{key: key}) {
+		writeError(w, http.StatusNotFound, internal.ErrorCodeInvalidRequest, fmt.Sprintf("no pending request #%d, it may be answered or timed out", answer.ID))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func pendingCommand() *cobra.Command {
+	var asJSON bool
+
+	pendingCmd := &cobra.Command{
+		Use:   "pending",
+		Short: "Approve requests waiting in a running op-agent",
+		Long: `Attach to the running op-agent and prompt for the requests waiting for
+approval, i.e., when it runs in the non-interactive mode. Press Ctrl-C to
+detach. The requests can also be listed and answered by the ID:
+
+  op-agent pending list
+  op-agent pending approve 3 --always
+  op-agent pending deny 4 --never`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			client := controlClientOrExit()
+			attachPending(client)
+		},
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the requests waiting for approval",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			requests, err := fetchPending(controlClientOrExit())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			if asJSON {
+				data, err := json.MarshalIndent(requests, "", "  ")
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error marshaling requests: %v\n", err)
+					os.Exit(1)
+				}
+				fmt.Printf("%s\n", data)
+				return
+			}
+
+			if len(requests) == 0 {
+				fmt.Printf("No pending requests\n")
+				return
+			}
+			for _, request := range requests {
+				fmt.Printf("  %d. op %s  (%s, %s)\n", request.ID, internal.FormatArgs(request.Args), callerLabel(request), pendingStatus(request))
+			}
+		},
+	}
+	listCmd.Flags().BoolVar(&asJSON, "json", false, "Print the requests as JSON")
+
+	var hour, session, always, project, everywhere bool
+
+	approveCmd := &cobra.Command{
+		Use:   "approve ID",
+		Short: "Approve a pending request, once unless specified",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			scope := "once"
+			switch {
+			case hour:
+				scope = "hour"
+			case session:
+				scope = "session"
+			case always:
+				scope = "always"
+			case project:
+				scope = "project"
+			case everywhere:
+				scope = "everywhere"
+			}
+			answerPendingOrExit(args[0], scope)
+			fmt.Printf("🟢 Request #%s approved (%s)\n", args[0], scope)
+		},
+	}
+	approveCmd.Flags().BoolVar(&hour, "hour", false, "Approve for an hour for the client")
+	approveCmd.Flags().BoolVar(&session, "session", false, "Approve until op-agent stops for the client")
+	approveCmd.Flags().BoolVar(&always, "always", false, "Approve always for the client")
+	approveCmd.Flags().BoolVar(&project, "project", false, "Approve always for the project")
+	approveCmd.Flags().BoolVar(&everywhere, "everywhere", false, "Approve always for every client")
+	approveCmd.MarkFlagsMutuallyExclusive("hour", "session", "always", "project", "everywhere")
+
+	var never bool
+
+	denyCmd := &cobra.Command{
+		Use:   "deny ID",
+		Short: "Deny a pending request",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			answer := "no"
+			if never {
+				answer = "never"
+			}
+			answerPendingOrExit(args[0], answer)
+			fmt.Printf("🔴 Request #%s denied\n", args[0])
+		},
+	}
+	denyCmd.Flags().BoolVar(&never, "never", false, "Also save a deny rule for the command")
+
+	pendingCmd.PersistentFlags().IntVar(&pendingPID, "pid", 0, "PID of the op-agent to connect to when several are running")
+
+	pendingCmd.AddCommand(listCmd)
+	pendingCmd.AddCommand(approveCmd)
+	pendingCmd.AddCommand(denyCmd)
+
+	return pendingCmd
+}
+
+// Prompts for the pending requests as they arrive, until interrupted.
+func attachPending(client *http.Client) {
+	fmt.Printf("🟣 Attached to op-agent, waiting for requests (Ctrl-C to detach)\n")
+
+	reader := bufio.NewReader(os.Stdin)
+	prompted := map[int]bool{}
+
+	for {
+		requests, err := fetchPending(client)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		var request *internal.PendingRequest
+		for i := range requests {
+			if !prompted[requests[i].ID] {
+				request = &requests[i]
+				break
+			}
+		}
+		if request == nil {
+			time.Sleep(pendingPollInterval)
+			continue
+		}
+		prompted[request.ID] = true
+
+		printPrompt(*request, nil)
+		if status := pendingStatus(*request); status != "" {
+			fmt.Printf("   %-14s %s\n\n", "Waiting:", status)
+		}
+		// The batch isn't offered, as the requests are answered one by one
+		fmt.Printf("%s", approvalOptions(*request, 0, true))
+
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		answer := answerForKey(strings.ToLower(strings.TrimSpace(line)))
+		if answer == "project" && projectOption(*request) == "" {
+			answer = "no"
+		}
+
+		if err := answerPending(client, request.ID, answer); err != nil {
+			fmt.Printf("   ⚠️  %v\n", err)
+			continue
+		}
+		fmt.Printf("   Answered: %s\n", answer)
+	}
+}
+
+// Maps the first character of the input to the answer name, denying
+// unknown keys.
+func answerForKey(input string) string {
+	if input == "" {
+		return "no"
+	}
+	key := input[0]
+	if key == 'y' {
+		key = 'o'
+	}
+	for name, answerKey := range answerKeys {
+		if answerKey != 0 && key == answerKey {
+			return name
+		}
+	}
+	return "no"
+}
+
+// Describes how long the request has been waiting and when it times out.
+func pendingStatus(request internal.PendingRequest) string {
+	var parts []string
+	if queuedAt, err := time.Parse(time.RFC3339, request.QueuedAt); err == nil {
+		parts = append(parts, "waiting "+formatRemaining(time.Since(queuedAt)))
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, request.ExpiresAt); err == nil {
+		parts = append(parts, "times out in "+formatRemaining(max(time.Until(expiresAt), 0)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Connects to the running op-agent, or the one with the --pid flag when
+// several are running.
+func controlClientOrExit() *http.Client {
+	sockets, err := internal.FindControlSockets()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var pids []string
+	var found []internal.ControlSocket
+	for _, socket := range sockets {
+		if pendingPID == 0 || socket.PID == pendingPID {
+			found = append(found, socket)
+			pids = append(pids, strconv.Itoa(socket.PID))
+		}
+	}
+
+	switch {
+	case len(found) == 0 && pendingPID != 0:
+		fmt.Fprintf(os.Stderr, "Error: No running op-agent with PID %d\n", pendingPID)
+		os.Exit(1)
+	case len(found) == 0:
+		fmt.Fprintf(os.Stderr, "Error: No running op-agent found, is it running?\n")
+		os.Exit(1)
+	case len(found) > 1:
+		fmt.Fprintf(os.Stderr, "Error: Several op-agent instances are running (PIDs %s), choose one with --pid\n", strings.Join(pids, ", "))
+		os.Exit(1)
+	}
+
+	return internal.NewControlClient(found[0].Path)
+}
+
+func fetchPending(client *http.Client) ([]internal.PendingRequest, error) {
+	resp, err := client.Get("http://op-agent" + internal.ControlPathPending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to op-agent, is it running? %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, controlError(resp)
+	}
+
+	var requests []internal.PendingRequest
+	if err := json.NewDecoder(resp.Body).Decode(&requests); err != nil {
+		return nil, fmt.Errorf("failed to parse pending requests: %v", err)
+	}
+	return requests, nil
+}
+
+func answerPending(client *http.Client, id int, answer string) error {
+	body, err := json.Marshal(internal.PendingAnswer{ID: id, Answer: answer})
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post("http://op-agent"+internal.ControlPathAnswer, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to connect to op-agent, is it running? %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return controlError(resp)
+	}
+	return nil
+}
+
+func answerPendingOrExit(idArg string, answer string) {
+	id, err := strconv.Atoi(idArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid ID %s, expected a number from 'op-agent pending list'\n", idArg)
+		os.Exit(1)
+	}
+
+	if err := answerPending(controlClientOrExit(), id, answer); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func controlError(resp *http.Response) error {
+	var errorResponse internal.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil || errorResponse.Error == "" {
+		return fmt.Errorf("op-agent responded with %s", resp.Status)
+	}
+	return fmt.Errorf("%s", errorResponse.Error)
+}
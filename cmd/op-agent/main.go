@@ -1,17 +1,20 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	opagent "github.com/kossnocorp/op-agent"
 	"github.com/kossnocorp/op-agent/internal"
@@ -21,43 +24,78 @@ import (
 var (
 	insecureMode   bool
 	nonInteractive bool
+	socketPath     string
+	listenAddress  string
+	allowNetworks  []string
+	tlsMode        bool
+	requirePairing bool
+	promptTimeout  time.Duration
+	nonceCache     = internal.NewNonceCache()
+	serverToken    string
+	// Config held in memory by the server
+	configStore *internal.ConfigStore
+	// Approvals for the lifetime of the server
+	sessionApprovals internal.SessionRules
+	// Approval prompts, started in the interactive mode
+	prompts *promptQueue
 )
 
 func handleOpCommand(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, internal.ErrorCodeMethodNotAllowed, "method not allowed")
 		return
 	}
 
 	var args []string
 	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, internal.ErrorCodeBodyTooLarge, fmt.Sprintf("request body is too large, maximum is %d bytes", maxBytesErr.Limit))
+			return
+		}
+		writeError(w, http.StatusBadRequest, internal.ErrorCodeInvalidJSON, "invalid JSON, expected an array of strings")
+		return
+	}
+
+	config := configStore.Config()
+
+	if validationErr := internal.ValidateArgs(args, config.GetLimits()); validationErr != nil {
+		if logErr := internal.LogDeniedRequest(r.RemoteAddr, r.URL.Path, validationErr.Reason); logErr != nil {
+			fmt.Printf("Warning: Failed to log rejected request: %v\n", logErr)
+		}
+		writeError(w, http.StatusBadRequest, validationErr.Code, validationErr.Message)
 		return
 	}
 
+	requester := internal.Requester{
+		Caller:  requestCaller(r),
+		Project: internal.ProjectFromRequest(r),
+	}
+
 	var approved bool
-	var persistent bool
+	var persist *internal.CommandRule
+	var source internal.ApprovalSource
 
-	// Approve command unless in insecure mode
-	if !insecureMode {
-		approved_, source, persistent_, err := approveCommand(args)
+	// Approve command unless in insecure mode, deny rules apply regardless
+	if !insecureMode || config.IsCommandDenied(args, requester) {
+		approved_, source_, persist_, err := approveCommand(config, args, requester)
 		if err != nil {
 			fmt.Printf("Error checking command approval: %v\n", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, internal.ErrorCodeInternal, "internal server error")
 			return
 		}
 
 		approved = approved_
-		persistent = persistent_
+		persist = persist_
+		source = source_
 
-		if logErr := internal.LogCommandRequest(args, approved_, source); logErr != nil {
+		if logErr := internal.LogCommandRequest(args, approved_, source_, requester); logErr != nil {
 			fmt.Printf("Warning: Failed to log command: %v\n", logErr)
 		}
 	} else {
 		approved = true
-		persistent = false
 
-		if logErr := internal.LogCommandRequest(args, true, internal.ApprovalSourceInsecure); logErr != nil {
+		if logErr := internal.LogCommandRequest(args, true, internal.ApprovalSourceInsecure, requester); logErr != nil {
 			fmt.Printf("Warning: Failed to log command: %v\n", logErr)
 		}
 	}
@@ -79,18 +117,9 @@ func handleOpCommand(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		// Save command to config only if it succeeded and was approved with "always"
-		if !insecureMode && persistent && exitCode == 0 {
-			config, err := internal.LoadConfig()
-			if err != nil {
-				fmt.Printf("Warning: Failed to load config for saving: %v\n", err)
-			} else {
-				config.AddApprovedCommand(args)
-
-				if saveErr := config.SaveConfig(); saveErr != nil {
-					fmt.Printf("Warning: Failed to save approved command to config: %v\n", saveErr)
-				}
-			}
+		// Save the approval only if the command succeeded
+		if persist != nil && exitCode == 0 {
+			saveApproval(*persist, source)
 		}
 
 		response = internal.OpResponse{
@@ -99,9 +128,19 @@ func handleOpCommand(w http.ResponseWriter, r *http.Request) {
 			Exit:   exitCode,
 		}
 	} else {
+		message := "The command wasn't approved by the host"
+		switch source {
+		case internal.ApprovalSourceDenyRule, internal.ApprovalSourceInteractiveNever:
+			message = "The command is blocked by a deny rule on the host"
+		case internal.ApprovalSourcePolicyDenyRule:
+			message = "The command is blocked by the system policy on the host"
+		case internal.ApprovalSourceInteractiveTimeout:
+			message = "The request timed out waiting for approval on the host"
+		}
+
 		response = internal.OpResponse{
 			Stdout: "",
-			Stderr: "The command wasn't approved by the host",
+			Stderr: message,
 			Exit:   1,
 		}
 	}
@@ -110,119 +149,369 @@ func handleOpCommand(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func approveCommand(args []string) (bool, internal.ApprovalSource, bool, error) {
-	config, err := internal.LoadConfig()
+// Returned by the update when no rule approves the command anymore.
+var errNoApprovedRule = errors.New("no approved rule")
+
+// Marks the rule approving the command used, returning false if there's no
+// such rule. The rule is looked up in the config on disk while holding the
+// lock, so concurrent requests can't exceed max_uses or use a rule revoked
+// since the config was cached.
+func useApprovedRule(args []string, requester internal.Requester) (bool, error) {
+	err := internal.UpdateConfig(func(config *internal.Config) error {
+		rule := config.FindApprovedRule(args, requester)
+		if rule == nil {
+			return errNoApprovedRule
+		}
+		rule.MarkUsed(time.Now())
+		return nil
+	})
+	if errors.Is(err, errNoApprovedRule) {
+		return false, nil
+	}
 	if err != nil {
-		return false, internal.ApprovalSourceNonInteractive, false, fmt.Errorf("failed to load config: %v", err)
+		return false, fmt.Errorf("failed to save approval usage: %v", err)
 	}
 
-	if config.IsCommandApproved(args) {
-		return true, internal.ApprovalSourceConfig, false, nil
+	if err := configStore.Reload(); err != nil {
+		fmt.Printf("Warning: Failed to reload config: %v\n", err)
 	}
+	return true, nil
+}
 
-	// If not interactive mode, deny commands not in config
-	if nonInteractive || !internal.IsInteractive() {
-		return false, internal.ApprovalSourceNonInteractive, false, nil
+// Approves the command for the requester, returning the rule to save if the
+// command succeeds.
+func approveCommand(config *internal.Config, args []string, requester internal.Requester) (bool, internal.ApprovalSource, *internal.CommandRule, error) {
+	// Deny rules take precedence over approvals, and the system policy over
+	// the user config
+	if config.IsCommandDeniedByPolicy(args, requester) {
+		return false, internal.ApprovalSourcePolicyDenyRule, nil, nil
+	}
+	if config.IsCommandDenied(args, requester) {
+		return false, internal.ApprovalSourceDenyRule, nil, nil
 	}
 
-	commandStr := strings.Join(args, " ")
-	fmt.Printf("\n🔵 Command approval required:\n\n   op %s\n\n", commandStr)
-	fmt.Printf("Approve? (y/o)nce, (a)lways, anything else for no: ")
+	if config.FindApprovedRule(args, requester) != nil {
+		used, err := useApprovedRule(args, requester)
+		if err != nil {
+			return false, "", nil, err
+		}
+		if used {
+			return true, internal.ApprovalSourceConfig, nil, nil
+		}
+		// The rule was revoked or used up since the config was cached
+	}
 
-	char, err := readSingleChar()
-	if err != nil {
-		return false, "", false, fmt.Errorf("failed to read input: %v", err)
+	if config.IsCommandApprovedByPolicy(args, requester) {
+		return true, internal.ApprovalSourcePolicy, nil, nil
 	}
-	response := strings.ToLower(string(char))
 
-	fmt.Printf("\n")
+	if sessionApprovals.Matches(args, requester) {
+		return true, internal.ApprovalSourceSession, nil, nil
+	}
+
+	// Without the terminal and the prompt timeout, deny commands not in
+	// config right away
+	if prompts == nil {
+		return false, internal.ApprovalSourceNonInteractive, nil, nil
+	}
+
+	// Concurrent requests are prompted one at a time
+	answer := prompts.ask(config, args, requester)
+	if answer.timedOut {
+		return false, internal.ApprovalSourceInteractiveTimeout, nil, nil
+	}
+	response := strings.ToLower(string(answer.key))
+	projectKey := requester.Project.Key()
+
+	// Without the project context, there's nothing to scope the approval to
+	if response == "p" && projectKey == "" {
+		response = ""
+	}
 
 	var approved = false
 	var source = internal.ApprovalSourceInteractiveDenied
-	var persistent = false
+	var persist *internal.CommandRule
+
+	// Approvals apply only to this caller unless approved for the project
+	// or everywhere
+	rule := internal.NewExactRule(args)
+	rule.Client = requester.Caller
 
 	switch response {
 	case "o", "y":
 		approved = true
 		source = internal.ApprovalSourceInteractiveOnce
-		persistent = false
+	case "b":
+		approved = true
+		source = internal.ApprovalSourceInteractiveBatch
+	case "h":
+		approved = true
+		source = internal.ApprovalSourceInteractiveHour
+		rule.SetExpiration(time.Now().Add(time.Hour))
+		persist = &rule
+	case "s":
+		approved = true
+		source = internal.ApprovalSourceInteractiveSession
+		persist = &rule
 	case "a":
 		approved = true
 		source = internal.ApprovalSourceInteractiveAlways
-		persistent = true
+		persist = &rule
+	case "p":
+		approved = true
+		source = internal.ApprovalSourceInteractiveProject
+		rule.Client = ""
+		rule.Project = projectKey
+		persist = &rule
+	case "e":
+		approved = true
+		source = internal.ApprovalSourceInteractiveEverywhere
+		rule.Client = ""
+		persist = &rule
+	case "n":
+		source = internal.ApprovalSourceInteractiveNever
+
+		// Unlike approvals, deny rules are saved right away
+		deny := internal.NewExactRule(args)
+		deny.SetProvenance(source, requester.Caller, time.Now())
+		err := configStore.Update(func(config *internal.Config) error {
+			config.AddDeniedRule(deny)
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("Warning: Failed to save denied command to config: %v\n", err)
+		}
+	}
+
+	if persist != nil {
+		persist.SetProvenance(source, requester.Caller, time.Now())
+	}
+
+	return approved, source, persist, nil
+}
+
+// Returns the project for the prompt with the details behind the key.
+func projectLabel(project internal.ProjectContext) string {
+	label := internal.QuoteArg(project.Key())
+
+	var details []string
+	if project.Devcontainer != "" && project.Devcontainer != project.Key() {
+		details = append(details, "devcontainer "+internal.QuoteArg(project.Devcontainer))
+	}
+	if project.Workspace != "" && project.Workspace != project.Key() {
+		details = append(details, "workspace "+internal.QuoteArg(project.Workspace))
+	}
+
+	if len(details) > 0 {
+		label += " (" + strings.Join(details, ", ") + ")"
+	}
+	return label
+}
+
+// Saves the interactive approval, keeping session approvals in memory.
+func saveApproval(rule internal.CommandRule, source internal.ApprovalSource) {
+	if source == internal.ApprovalSourceInteractiveSession {
+		sessionApprovals.Add(rule)
+		return
 	}
 
-	return approved, source, persistent, nil
+	// The command has just run with the approval
+	rule.MarkUsed(time.Now())
+
+	err := configStore.Update(func(config *internal.Config) error {
+		config.AddApprovedRule(rule)
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Warning: Failed to save approved command to config: %v\n", err)
+	}
 }
 
-func preApproveCommand(args []string) error {
-	config, err := internal.LoadConfig()
+// Adds the command or pattern to the approved list, returning false if it's
+// already approved.
+func preApproveCommand(args []string, options ruleOptions) (bool, error) {
+	rule, err := options.newRule(args)
 	if err != nil {
-		return fmt.Errorf("failed to load config: %v", err)
+		return false, err
 	}
+	rule.SetProvenance(internal.ApprovalSourceCLI, "", time.Now())
+
+	added := false
+	err = internal.UpdateConfig(func(config *internal.Config) error {
+		// User approvals can't override the system policy
+		if !rule.Pattern && config.IsCommandDeniedByPolicy(args, options.requester()) {
+			return fmt.Errorf("the command is denied by the system policy in %s", internal.GetPolicyPath())
+		}
 
-	if config.IsCommandApproved(args) {
-		fmt.Printf("Command already approved: op %s\n", strings.Join(args, " "))
+		// Exact commands can already be covered by a pattern
+		if !rule.Pattern && options.expires == 0 && options.maxUses == 0 && config.IsCommandApproved(args, options.requester()) {
+			return nil
+		}
+
+		added = config.AddApprovedRule(rule)
 		return nil
+	})
+	if err != nil {
+		return false, err
 	}
 
-	config.AddApprovedCommand(args)
+	return added, nil
+}
 
-	if err := config.SaveConfig(); err != nil {
-		return fmt.Errorf("failed to save config: %v", err)
+// Adds the command or pattern to the denied list, returning false if it's
+// already denied.
+func preDenyCommand(args []string, options ruleOptions) (bool, error) {
+	if options.maxUses > 0 {
+		return false, fmt.Errorf("--max-uses applies only to approvals")
+	}
+
+	rule, err := options.newRule(args)
+	if err != nil {
+		return false, err
 	}
+	rule.SetProvenance(internal.ApprovalSourceCLI, "", time.Now())
 
-	return nil
+	added := false
+	err = internal.UpdateConfig(func(config *internal.Config) error {
+		if !rule.Pattern && options.expires == 0 && config.IsCommandDenied(args, options.requester()) {
+			return nil
+		}
+
+		added = config.AddDeniedRule(rule)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return added, nil
 }
 
-func readSingleChar() (byte, error) {
-	// Try to set terminal to raw mode for immediate input
-	sttyCmd := exec.Command("stty", "-icanon", "-echo", "min", "1", "time", "0")
-	sttyCmd.Stdin = os.Stdin
-	sttyCmd.Stdout = os.Stdout
-	sttyCmd.Stderr = os.Stderr
-
-	if err := sttyCmd.Run(); err != nil {
-		// Fallback: if stty fails, just read normally
-		fmt.Printf("(Press Enter after choice) ")
-		reader := bufio.NewReader(os.Stdin)
-		input, err := reader.ReadString('\n')
-		if err != nil {
-			return 0, err
+// Options of the approve and deny commands.
+type ruleOptions struct {
+	pattern bool
+	expires time.Duration
+	maxUses int
+	client  internal.Caller
+	project string
+}
+
+// Parses `--pattern`, `--expires DURATION`, `--max-uses N`, `--client
+// CALLER` and `--project KEY`, accepting both `--option value` and
+// `--option=value`.
+func parseRuleOptions(options []string) (ruleOptions, error) {
+	var parsed ruleOptions
+
+	for i := 0; i < len(options); i++ {
+		name, value, hasValue := strings.Cut(options[i], "=")
+
+		if name == "--pattern" && !hasValue {
+			parsed.pattern = true
+			continue
 		}
-		input = strings.TrimSpace(input)
-		if len(input) > 0 {
-			return input[0], nil
+
+		if name != "--expires" && name != "--max-uses" && name != "--client" && name != "--project" {
+			return ruleOptions{}, fmt.Errorf("unknown option %s", options[i])
+		}
+
+		if !hasValue {
+			if i+1 >= len(options) {
+				return ruleOptions{}, fmt.Errorf("%s requires a value", name)
+			}
+			i++
+			value = options[i]
+		}
+
+		switch name {
+		case "--expires":
+			expires, err := internal.ParseDuration(value)
+			if err != nil || expires == 0 {
+				return ruleOptions{}, fmt.Errorf("invalid --expires value %s, expected a duration like 1h or 7d", value)
+			}
+			parsed.expires = expires
+		case "--max-uses":
+			maxUses, err := strconv.Atoi(value)
+			if err != nil || maxUses < 1 {
+				return ruleOptions{}, fmt.Errorf("invalid --max-uses value %s, expected a positive number", value)
+			}
+			parsed.maxUses = maxUses
+		case "--client":
+			client, err := internal.ParseCaller(value)
+			if err != nil {
+				return ruleOptions{}, err
+			}
+			parsed.client = client
+		case "--project":
+			if value == "" {
+				return ruleOptions{}, fmt.Errorf("--project requires a value")
+			}
+			parsed.project = value
 		}
-		return 'n', nil // Default to 'no'
 	}
 
-	// Restore normal terminal behavior on exit
-	defer func() {
-		restoreCmd := exec.Command("stty", "icanon", "echo")
-		restoreCmd.Stdin = os.Stdin
-		restoreCmd.Stdout = os.Stdout
-		restoreCmd.Stderr = os.Stderr
-		restoreCmd.Run()
-		fmt.Printf("\n") // Add newline after character input
-	}()
+	return parsed, nil
+}
 
-	// Read single character
-	var char [1]byte
-	n, err := os.Stdin.Read(char[:])
-	if err != nil {
-		return 0, err
+// Describes the caller and project the rule is scoped to, i.e., ` for
+// container:ID`.
+func (options ruleOptions) scope() string {
+	var scopes []string
+	if options.client != "" {
+		scopes = append(scopes, options.client.Short())
+	}
+	if options.project != "" {
+		scopes = append(scopes, "project "+internal.QuoteArg(options.project))
 	}
-	if n == 0 {
-		return 'n', nil // Default to 'no'
+
+	if len(scopes) == 0 {
+		return ""
+	}
+	return " for " + strings.Join(scopes, ", ")
+}
+
+// Returns the requester the scoped rule applies to, to check for existing
+// rules.
+func (options ruleOptions) requester() internal.Requester {
+	return internal.Requester{
+		Caller:  options.client,
+		Project: internal.ProjectContext{GitRemote: options.project},
 	}
+}
+
+// Creates the exact or pattern rule with the options' metadata.
+func (options ruleOptions) newRule(args []string) (internal.CommandRule, error) {
+	rule := internal.NewExactRule(args)
+	if options.pattern {
+		patternRule, err := internal.NewPatternRule(args)
+		if err != nil {
+			return internal.CommandRule{}, err
+		}
+		rule = patternRule
+	}
+
+	if options.expires > 0 {
+		rule.SetExpiration(time.Now().Add(options.expires))
+	}
+	rule.MaxUses = options.maxUses
+	rule.Client = options.client
+	rule.Project = options.project
+
+	return rule, nil
+}
 
-	return char[0], nil
+// Splits `[options...] op [command...]` into the options and the op args.
+func splitOpArgs(args []string) ([]string, []string, bool) {
+	for i, arg := range args {
+		if arg == "op" {
+			return args[:i], args[i+1:], true
+		}
+	}
+	return nil, nil, false
 }
 
 func handleHandshake(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, internal.ErrorCodeMethodNotAllowed, "method not allowed")
 		return
 	}
 
@@ -257,8 +546,7 @@ func main() {
 	}
 
 	rootCmd.Flags().BoolVar(&versionFlag, "version", false, "Print version information")
-	rootCmd.Flags().BoolVar(&insecureMode, "insecure", false, "Disable command approval checks (UNSAFE)")
-	rootCmd.Flags().BoolVar(&nonInteractive, "non-interactive", false, "Run in non-interactive mode (only allow pre-approved commands)")
+	addServerFlags(rootCmd)
 
 	startCmd := &cobra.Command{
 		Use:   "start",
@@ -272,49 +560,139 @@ func main() {
 		},
 	}
 
-	startCmd.Flags().BoolVar(&insecureMode, "insecure", false, "Disable command approval checks (UNSAFE)")
-	startCmd.Flags().BoolVar(&nonInteractive, "non-interactive", false, "Run in non-interactive mode (only allow pre-approved commands)")
+	addServerFlags(startCmd)
 
 	approveCmd := &cobra.Command{
-		Use:                "approve op [command...]",
-		Short:              "Pre-approve a 1Password CLI command",
-		Long:               "Add a 1Password CLI command to the approved commands list without executing it.",
+		Use:   "approve [--pattern] [--expires DURATION] [--max-uses N] [--client CALLER] [--project KEY] op [command...]",
+		Short: "Pre-approve a 1Password CLI command",
+		Long: `Add a 1Password CLI command to the approved commands list without executing it.
+
+With --pattern, each argument can be a glob (*, ?, [...]), a regex wrapped
+in slashes (/^dev-.*$/), or ... as the last argument to match any remaining
+arguments, i.e.:
+
+  op-agent approve --pattern op read 'op://dev/*/password'
+
+With --expires (i.e., 1h or 7d) and --max-uses, the approval is removed
+once it expires or runs out of uses. With --client (i.e., container:ID or
+client:ID), the approval applies only to that caller, and with --project
+(i.e., github.com/acme/api), only to that project.`,
 		DisableFlagParsing: true,
 		Run: func(cmd *cobra.Command, args []string) {
-			if args[0] != "op" {
-				fmt.Fprintf(os.Stderr, "Error: First argument must be 'op'\n")
-				fmt.Fprintf(os.Stderr, "Usage: op-agent approve op [command...]\n")
+			options, opArgs, ok := splitOpArgs(args)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Error: Command must start with 'op'\n")
+				fmt.Fprintf(os.Stderr, "Usage: op-agent approve [--pattern] [--expires DURATION] [--max-uses N] [--client CALLER] [--project KEY] op [command...]\n")
 				os.Exit(1)
 			}
 
-			// Everything after 'op' is the command to approve
-			opArgs := args[1:]
+			ruleOpts, err := parseRuleOptions(options)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
 
-			if err := preApproveCommand(opArgs); err != nil {
+			added, err := preApproveCommand(opArgs, ruleOpts)
+			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error approving command: %v\n", err)
 				os.Exit(1)
 			}
 
-			fmt.Printf("🟢 Command approved: op %s\n", strings.Join(opArgs, " "))
+			if !added {
+				fmt.Printf("Command already approved: op %s\n", internal.FormatArgs(opArgs))
+				return
+			}
+
+			fmt.Printf("🟢 Command approved: op %s%s\n", internal.FormatArgs(opArgs), ruleOpts.scope())
+		},
+	}
+
+	denyCmd := &cobra.Command{
+		Use:   "deny [--pattern] [--expires DURATION] [--client CALLER] [--project KEY] op [command...]",
+		Short: "Permanently deny a 1Password CLI command",
+		Long: `Add a 1Password CLI command to the denied commands list. Deny rules take
+precedence over approvals and apply even in the insecure mode.
+
+Accepts the same --pattern syntax as approve, i.e.:
+
+  op-agent deny --pattern op item delete ...`,
+		DisableFlagParsing: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			options, opArgs, ok := splitOpArgs(args)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Error: Command must start with 'op'\n")
+				fmt.Fprintf(os.Stderr, "Usage: op-agent deny [--pattern] [--expires DURATION] [--client CALLER] [--project KEY] op [command...]\n")
+				os.Exit(1)
+			}
+
+			ruleOpts, err := parseRuleOptions(options)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			added, err := preDenyCommand(opArgs, ruleOpts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error denying command: %v\n", err)
+				os.Exit(1)
+			}
+
+			if !added {
+				fmt.Printf("Command already denied: op %s\n", internal.FormatArgs(opArgs))
+				return
+			}
+
+			fmt.Printf("🔴 Command denied: op %s%s\n", internal.FormatArgs(opArgs), ruleOpts.scope())
 		},
 	}
 
 	rootCmd.AddCommand(startCmd)
 	rootCmd.AddCommand(approveCmd)
+	rootCmd.AddCommand(denyCmd)
+	rootCmd.AddCommand(approvalsCommand())
+	rootCmd.AddCommand(configCommand())
+	rootCmd.AddCommand(pairCommand())
+	rootCmd.AddCommand(clientsCommand())
+	rootCmd.AddCommand(pendingCommand())
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
 	}
 }
 
+func addServerFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&insecureMode, "insecure", false, "Disable command approval checks (UNSAFE)")
+	cmd.Flags().BoolVar(&nonInteractive, "non-interactive", false, "Run without the terminal prompt, requests that aren't pre-approved wait for 'op-agent pending' until the prompt timeout")
+	cmd.Flags().StringVar(&socketPath, "socket", "", "Listen on a Unix domain socket at PATH instead of TCP")
+	cmd.Flags().StringVar(&listenAddress, "listen", "", "Listen on ADDRESS or ADDRESS:PORT (default all interfaces)")
+	cmd.Flags().BoolVar(&requirePairing, "require-pairing", false, "Accept only requests signed by paired clients")
+	cmd.Flags().BoolVar(&tlsMode, "tls", false, "Serve HTTPS using the auto-provisioned local CA")
+	cmd.Flags().DurationVar(&promptTimeout, "prompt-timeout", defaultPromptTimeout, "Deny requests not answered within the duration, 0 waits forever or, with --non-interactive, denies right away")
+	cmd.Flags().StringSliceVar(&allowNetworks, "allow", nil, "Allow requests only from CIDR (repeatable, default loopback and Docker/Podman bridge networks)")
+}
+
 func startServer() error {
-	port, err := findAvailablePort(internal.StandardPort)
+	if _, err := internal.ParseNetworks(allowNetworks); err != nil {
+		return fmt.Errorf("invalid --allow value: %v", err)
+	}
+
+	token, err := internal.LoadOrCreateToken()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to load token: %v", err)
 	}
+	serverToken = token
 
-	if port != internal.StandardPort {
-		fmt.Printf("Port %d unavailable, using %d. Set %s=%d\n", internal.StandardPort, port, internal.AgentPortEnvName, port)
+	// Fail early on a broken config or system policy, later reloads keep the
+	// last good config instead
+	configStore, err = internal.NewConfigStore()
+	if err != nil {
+		return err
+	}
+	if configStore.Config().Policy() != nil {
+		fmt.Printf("🏢 System policy: %s\n", internal.GetPolicyPath())
+	}
+	if protected, _ := internal.IsConfigProtected(); protected {
+		fmt.Printf("🔒 Config protected with an HMAC\n")
 	}
 
 	if insecureMode {
@@ -322,18 +700,170 @@ func startServer() error {
 	}
 
 	opPath := fmt.Sprintf("/%s", internal.AgentCommandOp)
-	http.HandleFunc(opPath, handleOpCommand)
+	http.HandleFunc(opPath, protect(requireAuth(handleOpCommand)))
 
 	handshakePath := fmt.Sprintf("/%s", internal.AgentCommandHandshake)
-	http.HandleFunc(handshakePath, handleHandshake)
+	http.HandleFunc(handshakePath, protect(requireAuth(handleHandshake)))
+
+	// Pairing is authorized by the one-time code instead of the token
+	pairPath := fmt.Sprintf("/%s", internal.AgentCommandPair)
+	http.HandleFunc(pairPath, protect(handlePair))
+
+	listener, err := listen()
+	if err != nil {
+		return err
+	}
+
+	if tlsMode {
+		tlsConfig, caCert, err := internal.LoadOrCreateServerTLS(serverHosts())
+		if err != nil {
+			return fmt.Errorf("failed to set up TLS: %v", err)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+
+		fmt.Printf("🔒 TLS enabled, CA fingerprint: sha256:%s\n", internal.CertFingerprint(caCert))
+	}
+
+	// Requests are queued for the terminal prompt and `op-agent pending`.
+	// Without the terminal, they wait only until the prompt timeout.
+	interactive := !nonInteractive && internal.IsInteractive()
+	var controlListener net.Listener
+	if interactive || promptTimeout > 0 {
+		prompts = newPromptQueue(promptTimeout)
+
+		controlListener, err = startControlServer(prompts)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Close the listeners on exit so the socket files are removed. The
+	// server listener goes last, as closing it stops serving.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if controlListener != nil {
+			controlListener.Close()
+		}
+		if prompts != nil {
+			prompts.restoreTerminal()
+		}
+		listener.Close()
+		os.Exit(0)
+	}()
+
+	go watchConfig(configStore)
+
+	fmt.Printf("🟣 op-agent listening on %s\n\n", listenerAddress(listener))
+
+	// Switch the terminal to single-key input only once everything else is
+	// set up, and restore it if serving fails
+	if interactive {
+		prompts.start()
+		defer prompts.restoreTerminal()
+	}
+
+	err = http.Serve(listener, nil)
+	if errors.Is(err, net.ErrClosed) {
+		// Closed by the signal handler, which exits once it's done
+		select {}
+	}
+	return err
+}
+
+// Reloads the config when the config or the system policy file changes, or
+// on SIGHUP.
+func watchConfig(store *internal.ConfigStore) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	ticker := time.NewTicker(internal.ConfigPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hangups:
+			reloadConfig(store, "SIGHUP")
+		case <-ticker.C:
+			if store.Changed() {
+				reloadConfig(store, "file change")
+			}
+		}
+	}
+}
+
+func reloadConfig(store *internal.ConfigStore, trigger string) {
+	timestamp := time.Now().Format(time.RFC3339)
+	if err := store.Reload(); err != nil {
+		fmt.Printf("[%s] 🟡 Failed to reload config on %s, keeping the last good config: %v\n", timestamp, trigger, err)
+		return
+	}
+	fmt.Printf("[%s] 🔵 Config reloaded on %s\n", timestamp, trigger)
+}
+
+// Returns extra host names the clients use to reach the server, besides the
+// defaults. Used for the server certificate and Host header validation.
+func serverHosts() []string {
+	var hosts []string
 
-	fmt.Printf("🟣 op-agent listening on :%d\n\n", port)
-	return http.ListenAndServe(":"+strconv.Itoa(port), nil)
+	if listenAddress != "" {
+		host := listenAddress
+		if h, _, err := net.SplitHostPort(listenAddress); err == nil {
+			host = h
+		}
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+	}
+
+	if _, isSocket := internal.GetAgentSocket(false); !isSocket {
+		hosts = append(hosts, internal.GetAgentHost(false))
+	}
+
+	return hosts
+}
+
+func listen() (net.Listener, error) {
+	if socketPath != "" {
+		listener, err := internal.ListenUnixSocket(socketPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on socket: %v", err)
+		}
+		return listener, nil
+	}
+
+	// Use the exact port when specified, i.e., `--listen 127.0.0.1:4096`
+	if _, _, err := net.SplitHostPort(listenAddress); err == nil {
+		return net.Listen("tcp", listenAddress)
+	}
+
+	port, err := findAvailablePort(listenAddress, internal.StandardPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if port != internal.StandardPort {
+		fmt.Printf("Port %d unavailable, using %d. Set %s=%d\n", internal.StandardPort, port, internal.AgentPortEnvName, port)
+	}
+
+	return net.Listen("tcp", net.JoinHostPort(listenAddress, strconv.Itoa(port)))
+}
+
+func listenerAddress(listener net.Listener) string {
+	if listener.Addr().Network() == "unix" {
+		return "unix://" + listener.Addr().String()
+	}
+	return listener.Addr().String()
 }
 
-func findAvailablePort(startPort int) (int, error) {
+func findAvailablePort(host string, startPort int) (int, error) {
 	for port := startPort; port < startPort+100; port++ {
-		listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 		if err == nil {
 			listener.Close()
 			return port, nil
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/kossnocorp/op-agent/internal"
+)
+
+// Applies the checks shared by all endpoints.
+func protect(next http.HandlerFunc) http.HandlerFunc {
+	return requireAllowedSource(rejectBrowserRequests(limitBody(next)))
+}
+
+// Writes a structured error the client can show to the user.
+func writeError(w http.ResponseWriter, status int, code internal.ErrorCode, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(internal.ErrorResponse{Error: message, Code: code})
+}
+
+func denyRequest(w http.ResponseWriter, r *http.Request, reason internal.DenialReason, status int) {
+	if logErr := internal.LogDeniedRequest(r.RemoteAddr, r.URL.Path, reason); logErr != nil {
+		fmt.Printf("Warning: Failed to log rejected request: %v\n", logErr)
+	}
+
+	code := internal.ErrorCodeForbidden
+	switch status {
+	case http.StatusUnauthorized:
+		code = internal.ErrorCodeUnauthorized
+	case http.StatusRequestEntityTooLarge:
+		code = internal.ErrorCodeBodyTooLarge
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(internal.ErrorResponse{
+		Error:  fmt.Sprintf("request rejected: %s", reason),
+		Code:   code,
+		Reason: reason,
+	})
+}
+
+// Caps the request body at the configured size before anything reads it.
+func limitBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		maxBodyBytes := configStore.Config().GetLimits().MaxBodyBytes
+		if r.ContentLength > maxBodyBytes {
+			denyRequest(w, r, internal.DenialReasonBodyTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+
+		next(w, r)
+	}
+}
+
+// Rejects requests from peers outside of the allowed source networks.
+func requireAllowedSource(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Socket peers are already restricted by the file permissions
+		if socketPath != "" {
+			next(w, r)
+			return
+		}
+
+		if !internal.IsAddressAllowed(r.RemoteAddr, allowedNetworks()) {
+			denyRequest(w, r, internal.DenialReasonSourceNotAllowed, http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func allowedNetworks() []*net.IPNet {
+	if len(allowNetworks) == 0 {
+		return internal.DefaultAllowedNetworks()
+	}
+	// Validated in startServer
+	networks, _ := internal.ParseNetworks(allowNetworks)
+	return networks
+}
+
+// Rejects requests a web page could send to the agent. Browsers always add
+// Origin or Sec-Fetch-* headers to cross-origin requests and can't set custom
+// headers without a CORS preflight, which the agent never answers. The Host
+// check prevents DNS rebinding.
+func rejectBrowserRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAllowedHost(r.Host) {
+			denyRequest(w, r, internal.DenialReasonInvalidHost, http.StatusForbidden)
+			return
+		}
+
+		if r.Header.Get("Origin") != "" {
+			denyRequest(w, r, internal.DenialReasonBrowserOrigin, http.StatusForbidden)
+			return
+		}
+
+		for header := range r.Header {
+			if strings.HasPrefix(header, "Sec-Fetch-") {
+				denyRequest(w, r, internal.DenialReasonBrowserFetch, http.StatusForbidden)
+				return
+			}
+		}
+
+		if r.Header.Get(internal.RequestHeader) == "" {
+			denyRequest(w, r, internal.DenialReasonMissingRequestHeader, http.StatusForbidden)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				denyRequest(w, r, internal.DenialReasonInvalidContentType, http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// Checks the Host header. IP literals can't be rebound, so only host names
+// are matched against the known ones.
+func isAllowedHost(hostHeader string) bool {
+	host := hostHeader
+	if h, _, err := net.SplitHostPort(hostHeader); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+
+	if host == "" {
+		return false
+	}
+
+	if net.ParseIP(host) != nil {
+		return true
+	}
+
+	for _, allowed := range append(internal.DefaultServerHosts(), serverHosts()...) {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rejects requests that are neither signed by a paired client nor carry the
+// server token.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if reason, ok := authenticate(r); !ok {
+			status := http.StatusUnauthorized
+			if reason == internal.DenialReasonBodyTooLarge {
+				status = http.StatusRequestEntityTooLarge
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			denyRequest(w, r, reason, status)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func authenticate(r *http.Request) (internal.DenialReason, bool) {
+	clientID := r.Header.Get(internal.ClientIDHeader)
+	if clientID == "" {
+		if requirePairing {
+			return internal.DenialReasonPairingRequired, false
+		}
+		return internal.CheckAuthHeader(r, serverToken)
+	}
+
+	client := configStore.Config().FindClient(clientID)
+	if client == nil {
+		return internal.DenialReasonUnknownClient, false
+	}
+
+	return internal.VerifyRequestSignature(r, client, nonceCache)
+}
+
+// Identifies the caller for scoped approvals. Must be called after
+// requireAuth, which verifies the signature of paired clients. Otherwise,
+// the container ID reported by the client or the remote address is used.
+func requestCaller(r *http.Request) internal.Caller {
+	if clientID := r.Header.Get(internal.ClientIDHeader); clientID != "" {
+		return internal.ClientCaller(clientID)
+	}
+
+	if containerID := r.Header.Get(internal.ContainerIDHeader); internal.IsValidContainerID(containerID) {
+		return internal.ContainerCaller(containerID)
+	}
+
+	if socketPath != "" {
+		return internal.CallerSocket
+	}
+
+	return internal.AddressCaller(r.RemoteAddr)
+}
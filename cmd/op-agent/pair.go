@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kossnocorp/op-agent/internal"
+	"github.com/spf13/cobra"
+)
+
+const maxPairRequestBytes = 4096
+
+func handlePair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, internal.ErrorCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var request internal.PairRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxPairRequestBytes)
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, internal.ErrorCodeInvalidJSON, "invalid JSON")
+		return
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(request.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		writeError(w, http.StatusBadRequest, internal.ErrorCodeInvalidRequest, "invalid public key")
+		return
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if err := internal.ValidateClientName(name); err != nil {
+		writeError(w, http.StatusBadRequest, internal.ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+	if name == "" {
+		name = r.RemoteAddr
+	}
+
+	if err := internal.ConsumePairingCode(request.Code); err != nil {
+		if logErr := internal.LogDeniedRequest(r.RemoteAddr, r.URL.Path, internal.DenialReasonInvalidPairing); logErr != nil {
+			fmt.Printf("Warning: Failed to log rejected request: %v\n", logErr)
+		}
+		writeError(w, http.StatusForbidden, internal.ErrorCodeForbidden, err.Error())
+		return
+	}
+
+	id, err := internal.NewClientID()
+	if err != nil {
+		fmt.Printf("Error pairing client: %v\n", err)
+		writeError(w, http.StatusInternalServerError, internal.ErrorCodeInternal, "internal server error")
+		return
+	}
+
+	err = configStore.Update(func(config *internal.Config) error {
+		config.AddClient(internal.PairedClient{
+			ID:        id,
+			Name:      name,
+			PublicKey: request.PublicKey,
+			CreatedAt: time.Now().Format(time.RFC3339),
+		})
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error saving paired client: %v\n", err)
+		writeError(w, http.StatusInternalServerError, internal.ErrorCodeInternal, "internal server error")
+		return
+	}
+
+	fmt.Printf("[%s] 🟢 Paired client %s (%s) from %s\n", time.Now().Format(time.RFC3339), internal.QuoteArg(name), id, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(internal.PairResponse{ID: id})
+}
+
+func pairCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "pair",
+		Short: "Generate a one-time code to pair a client",
+		Long:  "Generate a one-time code that op-agent-client exchanges for a per-client identity.",
+		Run: func(cmd *cobra.Command, args []string) {
+			code, expiresAt, err := internal.CreatePairingCode()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating pairing code: %v\n", err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("🔵 Pairing code: %s (expires at %s)\n\n", code, expiresAt.Format(time.Kitchen))
+			fmt.Printf("Run in the container:\n\n   op-agent-client pair %s\n", code)
+		},
+	}
+}
+
+func clientsCommand() *cobra.Command {
+	clientsCmd := &cobra.Command{
+		Use:   "clients",
+		Short: "Manage paired clients",
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List paired clients",
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := internal.LoadConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+				os.Exit(1)
+			}
+
+			if len(config.Clients) == 0 {
+				fmt.Printf("No paired clients\n")
+				return
+			}
+
+			for _, client := range config.Clients {
+				fmt.Printf("%s  %s  (paired %s)\n", client.ID, internal.QuoteArg(client.Name), client.CreatedAt)
+			}
+		},
+	}
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke ID",
+		Short: "Revoke a paired client",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := internal.UpdateConfig(func(config *internal.Config) error {
+				if !config.RemoveClient(args[0]) {
+					return fmt.Errorf("no paired client with ID %s", args[0])
+				}
+				return nil
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("🔴 Client revoked: %s\n", args[0])
+		},
+	}
+
+	clientsCmd.AddCommand(listCmd)
+	clientsCmd.AddCommand(revokeCmd)
+
+	return clientsCmd
+}
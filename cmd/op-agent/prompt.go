@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kossnocorp/op-agent/internal"
+)
+
+// Maximum number of waiting requests listed under the prompt.
+const maxListedRequests = 5
+
+// Default time to wait for an answer before denying the request.
+const defaultPromptTimeout = 2 * time.Minute
+
+// Answer to the approval prompt.
+type promptAnswer struct {
+	key      byte
+	timedOut bool // Nobody answered in time
+}
+
+// Approval request waiting for the prompt.
+type pendingRequest struct {
+	id        int
+	args      []string
+	requester internal.Requester
+	config    *internal.Config
+	queuedAt  time.Time
+	deadline  time.Time // Zero without the timeout
+
+	answer   promptAnswer  // Set before resolved is closed
+	resolved chan struct{} // Closed once answered
+}
+
+// Serializes the approval prompts of concurrent requests. Requests are
+// queued and prompted one at a time in order, and a single goroutine reads
+// stdin, so keypresses always go to the displayed prompt.
+type promptQueue struct {
+	mutex   sync.Mutex
+	pending []*pendingRequest
+	nextID  int
+	wake    chan struct{}
+	timeout time.Duration // 0 waits forever
+
+	terminal bool // Prompts on the terminal, otherwise only via the control channel
+	keys     chan byte
+	restore  func() // Restores the terminal mode
+}
+
+func newPromptQueue(timeout time.Duration) *promptQueue {
+	return &promptQueue{
+		wake:    make(chan struct{}, 1),
+		keys:    make(chan byte, 16),
+		timeout: timeout,
+	}
+}
+
+// Switches the terminal to single-key input and starts prompting. The
+// terminal stays in this mode until restoreTerminal, instead of toggling it
+// for every prompt.
+func (q *promptQueue) start() {
+	q.terminal = true
+	raw := enableSingleKeyInput()
+	if raw {
+		q.restore = restoreTerminalInput
+	}
+	go q.readKeys(raw)
+	go q.run()
+}
+
+func (q *promptQueue) restoreTerminal() {
+	if q.restore != nil {
+		q.restore()
+	}
+}
+
+// Queues the request and blocks until it's answered or times out.
+func (q *promptQueue) ask(config *internal.Config, args []string, requester internal.Requester) promptAnswer {
+	// The timeout counts from the request, including the time in the queue,
+	// so the client isn't left hanging behind other prompts. The request is
+	// complete before it's queued, as the prompt reads it without the lock.
+	queuedAt := time.Now()
+	var deadline time.Time
+	if q.timeout > 0 {
+		deadline = queuedAt.Add(q.timeout)
+	}
+
+	q.mutex.Lock()
+	q.nextID++
+	request := &pendingRequest{
+		id:        q.nextID,
+		args:      args,
+		requester: requester,
+		config:    config,
+		queuedAt:  queuedAt,
+		deadline:  deadline,
+		resolved:  make(chan struct{}),
+	}
+	q.pending = append(q.pending, request)
+	terminal := q.terminal
+	q.mutex.Unlock()
+
+	if q.timeout > 0 {
+		timer := time.AfterFunc(time.Until(deadline), func() {
+			q.resolve(request.id, promptAnswer{timedOut: true})
+		})
+		defer timer.Stop()
+	}
+
+	if terminal {
+		q.notify()
+	} else {
+		request.printWaiting()
+	}
+
+	<-request.resolved
+	return request.answer
+}
+
+// Answers the pending request, returning false if it's already answered.
+func (q *promptQueue) resolve(id int, answer promptAnswer) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i, request := range q.pending {
+		if request.id == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			request.answer = answer
+			close(request.resolved)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the pending requests in order.
+func (q *promptQueue) list() []internal.PendingRequest {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	views := make([]internal.PendingRequest, 0, len(q.pending))
+	for _, request := range q.pending {
+		views = append(views, request.view())
+	}
+	return views
+}
+
+// Returns the pending request with the ID.
+func (q *promptQueue) find(id int) (internal.PendingRequest, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, request := range q.pending {
+		if request.id == id {
+			return request.view(), true
+		}
+	}
+	return internal.PendingRequest{}, false
+}
+
+// Returns the first pending request and the ones waiting after it.
+func (q *promptQueue) next() (*pendingRequest, []*pendingRequest) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.pending) == 0 {
+		return nil, nil
+	}
+	waiting := make([]*pendingRequest, len(q.pending)-1)
+	copy(waiting, q.pending[1:])
+	return q.pending[0], waiting
+}
+
+func (q *promptQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Prompts the pending requests one at a time.
+func (q *promptQueue) run() {
+	for {
+		current, waiting := q.next()
+		if current == nil {
+			<-q.wake
+			continue
+		}
+
+		views := make([]internal.PendingRequest, 0, len(waiting))
+		for _, request := range waiting {
+			views = append(views, request.view())
+		}
+		printPrompt(current.view(), views)
+
+		// Batch only the requests listed in the prompt, not the ones behind
+		// "…and N more" or queued since
+		batch := waiting[:min(len(waiting), maxListedRequests)]
+		fmt.Printf("%s", approvalOptions(current.view(), len(batch), false))
+		countdown := newCountdown(current.deadline)
+
+		// Drop keys pressed before the prompt was displayed
+		for drained := false; !drained; {
+			select {
+			case _, ok := <-q.keys:
+				drained = !ok
+			default:
+				drained = true
+			}
+		}
+
+		answered := q.waitForAnswer(current, batch, countdown)
+		countdown.stop()
+		if !answered {
+			return
+		}
+	}
+}
+
+// Stops prompting on the terminal once stdin is closed, leaving the
+// requests to `op-agent pending`.
+func (q *promptQueue) detachTerminal() {
+	q.mutex.Lock()
+	q.terminal = false
+	pending := make([]*pendingRequest, len(q.pending))
+	copy(pending, q.pending)
+	q.mutex.Unlock()
+
+	fmt.Printf("🟡 Stdin is closed, answer the requests with 'op-agent pending'\n")
+	for _, request := range pending {
+		request.printWaiting()
+	}
+}
+
+// Waits for a key or for the request to be answered otherwise, i.e., by
+// the timeout, updating the countdown. Returns false if stdin is closed,
+// so the terminal can't answer anymore.
+func (q *promptQueue) waitForAnswer(current *pendingRequest, batch []*pendingRequest, countdown *countdown) bool {
+	for {
+		select {
+		case key, ok := <-q.keys:
+			fmt.Printf("\n")
+			if !ok {
+				q.detachTerminal()
+				return false
+			}
+			if key == 'b' || key == 'B' {
+				if len(batch) == 0 {
+					// The batch wasn't offered, so it's just another key
+					key = 0
+				}
+				for _, request := range batch {
+					q.resolve(request.id, promptAnswer{key: 'b'})
+				}
+			}
+			q.resolve(current.id, promptAnswer{key: key})
+			return true
+
+		case <-current.resolved:
+			if current.answer.timedOut {
+				fmt.Printf("\n   ⏱️  Timed out waiting for an answer\n")
+			} else {
+				fmt.Printf("\n   (answered via op-agent pending)\n")
+			}
+			return true
+
+		case <-countdown.ticks():
+			countdown.print()
+		}
+	}
+}
+
+// Reads the keys from stdin for the prompts. Without single-key input,
+// the first character of each line is used.
+func (q *promptQueue) readKeys(raw bool) {
+	defer close(q.keys)
+
+	if !raw {
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			var key byte // Default to 'no'
+			if len(line) > 0 {
+				key = line[0]
+			}
+			q.send(key)
+		}
+	}
+
+	var buf [1]byte
+	for {
+		n, err := os.Stdin.Read(buf[:])
+		if err != nil {
+			return
+		}
+		if n > 0 {
+			q.send(buf[0])
+		}
+	}
+}
+
+// Sends the key to the prompt, dropping it if nobody is reading.
+func (q *promptQueue) send(key byte) {
+	select {
+	case q.keys <- key:
+	default:
+	}
+}
+
+// Logs the request waiting for `op-agent pending` without the terminal.
+func (r *pendingRequest) printWaiting() {
+	fmt.Printf("[%s] ⏳ Waiting for approval via 'op-agent pending': op %s (%s)\n", r.queuedAt.Format(time.RFC3339), internal.FormatArgs(r.args), r.requester.Caller.Short())
+}
+
+// Returns the request for the prompt and the control channel.
+func (r *pendingRequest) view() internal.PendingRequest {
+	view := internal.PendingRequest{
+		ID:       r.id,
+		Args:     r.args,
+		Client:   r.requester.Caller,
+		QueuedAt: r.queuedAt.Format(time.RFC3339),
+	}
+	if id, ok := strings.CutPrefix(string(r.requester.Caller), "client:"); ok {
+		if client := r.config.FindClient(id); client != nil {
+			view.ClientName = client.Name
+		}
+	}
+	if !r.requester.Project.IsEmpty() {
+		project := r.requester.Project
+		view.Project = &project
+	}
+	if !r.deadline.IsZero() {
+		view.ExpiresAt = r.deadline.Format(time.RFC3339)
+	}
+	return view
+}
+
+// Prints the request details and the waiting requests, without the options.
+func printPrompt(request internal.PendingRequest, waiting []internal.PendingRequest) {
+	args := request.Args
+	opCmd := internal.ParseOpCommand(args)
+
+	fmt.Printf("\n🔵 Command approval required:\n\n   op %s\n\n", internal.FormatArgs(args))
+
+	details := [][2]string{{"Client", callerLabel(request)}}
+	if request.Project != nil && request.Project.Key() != "" {
+		details = append(details, [2]string{"Project", projectLabel(*request.Project)})
+	}
+	details = append(details, opCmd.Details()...)
+	for _, detail := range details {
+		fmt.Printf("   %-14s %s\n", detail[0]+":", detail[1])
+	}
+	fmt.Printf("\n")
+
+	warnings := append(internal.ArgWarnings(args), internal.ClientNameWarnings(request.ClientName)...)
+	if len(warnings) > 0 {
+		for _, warning := range warnings {
+			fmt.Printf("   ⚠️  %s\n", warning)
+		}
+		fmt.Printf("\n")
+	}
+
+	if len(waiting) > 0 {
+		fmt.Printf("   ⏳ %d more waiting:\n", len(waiting))
+		for i, request := range waiting {
+			if i == maxListedRequests {
+				fmt.Printf("      …and %d more\n", len(waiting)-i)
+				break
+			}
+			fmt.Printf("      op %s  (%s)\n", internal.FormatArgs(request.Args), request.Client.Short())
+		}
+		fmt.Printf("\n")
+	}
+}
+
+// Returns the approval question with the options for the request, offering
+// the batch for the number of listed requests. With line input, the answer
+// is submitted with Enter.
+func approvalOptions(request internal.PendingRequest, batch int, lineInput bool) string {
+	submit := ": "
+	if lineInput {
+		submit = ", then Enter: "
+	}
+	return fmt.Sprintf("Approve? (y/o)nce, %s(h)our, (s)ession, (a)lways for this client, %s(e)verywhere always, (n)ever, anything else for no%s", batchOption(batch), projectOption(request), submit)
+}
+
+func batchOption(count int) string {
+	if count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("(b)atch once with the %d listed, ", count)
+}
+
+// Without the project context, there's nothing to scope the approval to.
+func projectOption(request internal.PendingRequest) string {
+	if request.Project == nil || request.Project.Key() == "" {
+		return ""
+	}
+	return "(p)roject always, "
+}
+
+// Returns the caller for the prompt, with the name of paired clients.
+func callerLabel(request internal.PendingRequest) string {
+	if request.ClientName != "" {
+		return fmt.Sprintf("%s (%s)", request.Client, internal.QuoteArg(request.ClientName))
+	}
+	return request.Client.Short()
+}
+
+// Remaining time displayed at the end of the prompt, rewritten every
+// second with backspaces.
+type countdown struct {
+	deadline time.Time
+	ticker   *time.Ticker
+	printed  int // Length of the displayed text
+}
+
+func newCountdown(deadline time.Time) *countdown {
+	c := &countdown{deadline: deadline}
+	if !deadline.IsZero() {
+		c.ticker = time.NewTicker(time.Second)
+		c.print()
+	}
+	return c
+}
+
+// Returns the tick channel, nil without the deadline, so it never fires.
+func (c *countdown) ticks() <-chan time.Time {
+	if c.ticker == nil {
+		return nil
+	}
+	return c.ticker.C
+}
+
+func (c *countdown) print() {
+	remaining := max(time.Until(c.deadline).Round(time.Second), 0)
+	text := fmt.Sprintf("[%s] ", formatRemaining(remaining))
+
+	erase := strings.Repeat("\b", c.printed)
+	padding := ""
+	if len(text) < c.printed {
+		// Clear the rest of the longer previous text
+		padding = strings.Repeat(" ", c.printed-len(text)) + strings.Repeat("\b", c.printed-len(text))
+	}
+	fmt.Printf("%s%s%s", erase, text, padding)
+	c.printed = len(text)
+}
+
+func (c *countdown) stop() {
+	if c.ticker != nil {
+		c.ticker.Stop()
+	}
+}
+
+// Switches the terminal to unbuffered input without echo, returning false
+// if stty isn't available.
+func enableSingleKeyInput() bool {
+	sttyCmd := exec.Command("stty", "-icanon", "-echo", "min", "1", "time", "0")
+	sttyCmd.Stdin = os.Stdin
+	sttyCmd.Stdout = os.Stdout
+	sttyCmd.Stderr = os.Stderr
+
+	if err := sttyCmd.Run(); err != nil {
+		fmt.Printf("(Press Enter after choice in approval prompts)\n")
+		return false
+	}
+	return true
+}
+
+func restoreTerminalInput() {
+	restoreCmd := exec.Command("stty", "icanon", "echo")
+	restoreCmd.Stdin = os.Stdin
+	restoreCmd.Stdout = os.Stdout
+	restoreCmd.Stderr = os.Stderr
+	restoreCmd.Run()
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+)
+
+// Rule lists managed by `op-agent approvals`.
+type RuleList string
+
+const (
+	RuleListApproved RuleList = "approved"
+	RuleListDenied   RuleList = "denied"
+)
+
+// Returns the rules of the list.
+func (c *Config) Rules(list RuleList) []CommandRule {
+	if list == RuleListDenied {
+		return c.DeniedCommands
+	}
+	return c.ApprovedCommands
+}
+
+func (c *Config) setRules(list RuleList, rules []CommandRule) {
+	if list == RuleListDenied {
+		c.DeniedCommands = rules
+	} else {
+		c.ApprovedCommands = rules
+	}
+}
+
+// Returns the rule by its 1-based index in the list, as displayed by
+// `op-agent approvals list`.
+func (c *Config) RuleAt(list RuleList, index int) (*CommandRule, error) {
+	rules := c.Rules(list)
+	if index < 1 || index > len(rules) {
+		return nil, fmt.Errorf("no %s rule #%d, there are %d", list, index, len(rules))
+	}
+	return &rules[index-1], nil
+}
+
+// Removes the rules by their 1-based indices, returning the removed rules.
+// All indices are validated first, so nothing is removed on error.
+func (c *Config) RemoveRulesAt(list RuleList, indices []int) ([]CommandRule, error) {
+	remove := map[int]bool{}
+	for _, index := range indices {
+		if _, err := c.RuleAt(list, index); err != nil {
+			return nil, err
+		}
+		remove[index-1] = true
+	}
+
+	var removed []CommandRule
+	kept := make([]CommandRule, 0, len(c.Rules(list)))
+	for i, rule := range c.Rules(list) {
+		if remove[i] {
+			removed = append(removed, rule)
+		} else {
+			kept = append(kept, rule)
+		}
+	}
+	c.setRules(list, kept)
+
+	return removed, nil
+}
+
+// Removes the rules with the same arguments as the given one, regardless
+// of the scope and metadata, returning the removed rules.
+func (c *Config) RemoveEqualRules(list RuleList, rule CommandRule) []CommandRule {
+	var removed []CommandRule
+	kept := make([]CommandRule, 0, len(c.Rules(list)))
+	for _, existing := range c.Rules(list) {
+		if existing.Equal(rule) {
+			removed = append(removed, existing)
+		} else {
+			kept = append(kept, existing)
+		}
+	}
+	c.setRules(list, kept)
+
+	return removed
+}
+
+// Removes approvals that weren't used for the duration, returning the
+// removed rules. Approvals that were never used count from when they were
+// added, and ones without either time, i.e., added before usage tracking,
+// are kept.
+func (c *Config) PruneUnusedApprovals(now time.Time, unusedFor time.Duration) []CommandRule {
+	var removed []CommandRule
+	kept := make([]CommandRule, 0, len(c.ApprovedCommands))
+	for _, rule := range c.ApprovedCommands {
+		usedAt, ok := rule.LastUsed()
+		if !ok {
+			usedAt, ok = rule.Created()
+		}
+		if ok && now.Sub(usedAt) >= unusedFor {
+			removed = append(removed, rule)
+		} else {
+			kept = append(kept, rule)
+		}
+	}
+	c.ApprovedCommands = kept
+
+	return removed
+}
+
+// Validates the rule before saving it.
+func ValidateRule(rule CommandRule) error {
+	if len(rule.Args) == 0 {
+		return fmt.Errorf("the command is empty")
+	}
+	if rule.Pattern {
+		if err := ValidatePattern(rule.Args); err != nil {
+			return err
+		}
+	}
+	if rule.ExpiresAt != "" {
+		if _, ok := rule.Expiration(); !ok {
+			return fmt.Errorf("invalid expires_at %s, expected an RFC 3339 time", QuoteArg(rule.ExpiresAt))
+		}
+	}
+	if rule.MaxUses < 0 || rule.Uses < 0 {
+		return fmt.Errorf("max_uses and uses can't be negative")
+	}
+	if rule.Client != "" {
+		if _, err := ParseCaller(string(rule.Client)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Shared-secret token file stored next to config.json.
+const TokenFileName = "token"
+
+const tokenBytes = 32
+
+// Custom header sent by op-agent-client with every request. Browsers can't set
+// it on cross-origin requests without a CORS preflight.
+const RequestHeader = "X-Op-Agent-Request"
+
+func GetTokenPath() (string, error) {
+	configDir, err := GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, TokenFileName), nil
+}
+
+// Loads the server token or generates a new random one on the first start.
+func LoadOrCreateToken() (string, error) {
+	tokenPath, err := GetTokenPath()
+	if err != nil {
+		return "", err
+	}
+
+	token, err := readTokenFile(tokenPath)
+	if err == nil && token != "" {
+		return token, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read token file: %v", err)
+	}
+
+	buf := make([]byte, tokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	token = hex.EncodeToString(buf)
+
+	if err := os.WriteFile(tokenPath, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write token file: %v", err)
+	}
+
+	return token, nil
+}
+
+func readTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Resolves the client token from OP_AGENT_TOKEN, OP_AGENT_TOKEN_FILE or the
+// default token path (when the client runs on the host or the file is mounted).
+func GetAgentToken() (string, error) {
+	if token := os.Getenv(AgentTokenEnvName); token != "" {
+		return strings.TrimSpace(token), nil
+	}
+
+	if tokenPath := os.Getenv(AgentTokenFileEnvName); tokenPath != "" {
+		token, err := readTokenFile(tokenPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", AgentTokenFileEnvName, err)
+		}
+		return token, nil
+	}
+
+	configDir, err := getConfigDirPath()
+	if err != nil {
+		return "", nil
+	}
+	token, err := readTokenFile(filepath.Join(configDir, TokenFileName))
+	if err != nil {
+		// No token available, let the server reject the request
+		return "", nil
+	}
+	return token, nil
+}
+
+func SetAuthHeader(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// Checks the request bearer token against the server token in constant time.
+func CheckAuthHeader(r *http.Request, token string) (DenialReason, bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return DenialReasonMissingToken, false
+	}
+	provided, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		return DenialReasonInvalidToken, false
+	}
+	return "", true
+}
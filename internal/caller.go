@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Container ID sent by op-agent-client when running in a container.
+const ContainerIDHeader = "X-Op-Agent-Container"
+
+// Identity of the caller that approvals can be scoped to, i.e.,
+// `client:ID` for paired clients, `container:ID` for containers,
+// `ip:ADDRESS` for other TCP clients, or `socket` for Unix socket clients.
+type Caller string
+
+const CallerSocket Caller = "socket"
+
+const (
+	callerClientPrefix    = "client:"
+	callerContainerPrefix = "container:"
+	callerAddressPrefix   = "ip:"
+)
+
+var (
+	containerIDRegexp = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z_.-]{0,127}$`)
+	// Docker and Podman keep per-container files under containers/ID/
+	mountContainerIDRegexp  = regexp.MustCompile(`containers/([0-9a-f]{64})/`)
+	cgroupContainerIDRegexp = regexp.MustCompile(`[0-9a-f]{64}`)
+)
+
+func ClientCaller(id string) Caller {
+	return Caller(callerClientPrefix + id)
+}
+
+func ContainerCaller(id string) Caller {
+	return Caller(callerContainerPrefix + id)
+}
+
+// Returns the caller for the remote address of a TCP request.
+func AddressCaller(remoteAddr string) Caller {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if host == "" || host == "@" {
+		return CallerSocket
+	}
+	return Caller(callerAddressPrefix + host)
+}
+
+// Parses the caller given on the command line, i.e., `container:ID`.
+func ParseCaller(value string) (Caller, error) {
+	if Caller(value) == CallerSocket {
+		return CallerSocket, nil
+	}
+
+	for _, prefix := range []string{callerClientPrefix, callerContainerPrefix, callerAddressPrefix} {
+		if id, ok := strings.CutPrefix(value, prefix); ok && id != "" {
+			return Caller(value), nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid client %s, expected client:ID, container:ID, ip:ADDRESS or socket", QuoteArg(value))
+}
+
+// Checks the container ID reported by the client.
+func IsValidContainerID(id string) bool {
+	return containerIDRegexp.MatchString(id)
+}
+
+// Returns the caller for display, shortening container IDs like Docker does.
+func (c Caller) Short() string {
+	if id, ok := strings.CutPrefix(string(c), callerContainerPrefix); ok && len(id) > 12 {
+		return callerContainerPrefix + id[:12]
+	}
+	return string(c)
+}
+
+// Detects the ID of the container the client runs in, from
+// OP_AGENT_CONTAINER_ID or the mounts and cgroups of the process. Returns an
+// empty string if the ID is unknown.
+func GetContainerID() string {
+	if id := os.Getenv(AgentContainerIDEnvName); id != "" {
+		return id
+	}
+
+	if data, err := os.ReadFile("/proc/self/mountinfo"); err == nil {
+		if match := mountContainerIDRegexp.FindSubmatch(data); match != nil {
+			return string(match[1])
+		}
+	}
+
+	if data, err := os.ReadFile("/proc/self/cgroup"); err == nil {
+		if match := cgroupContainerIDRegexp.Find(data); match != nil {
+			return string(match)
+		}
+	}
+
+	return ""
+}
@@ -6,7 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
-	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,26 +14,83 @@ import (
 type ApprovalSource string
 
 const (
-	ApprovalSourceConfig            ApprovalSource = "config"
-	ApprovalSourceInteractiveOnce   ApprovalSource = "interactive-once"
-	ApprovalSourceInteractiveAlways ApprovalSource = "interactive-always"
-	ApprovalSourceInteractiveDenied ApprovalSource = "interactive-denied"
-	ApprovalSourceNonInteractive    ApprovalSource = "non-interactive"
-	ApprovalSourceInsecure          ApprovalSource = "insecure"
+	ApprovalSourceConfig                ApprovalSource = "config"
+	ApprovalSourceInteractiveOnce       ApprovalSource = "interactive-once"
+	ApprovalSourceInteractiveAlways     ApprovalSource = "interactive-always"
+	ApprovalSourceInteractiveDenied     ApprovalSource = "interactive-denied"
+	ApprovalSourceNonInteractive        ApprovalSource = "non-interactive"
+	ApprovalSourceInsecure              ApprovalSource = "insecure"
+	ApprovalSourceDenyRule              ApprovalSource = "deny-rule"
+	ApprovalSourceInteractiveNever      ApprovalSource = "interactive-never"
+	ApprovalSourceInteractiveEverywhere ApprovalSource = "interactive-everywhere"
+	ApprovalSourceInteractiveProject    ApprovalSource = "interactive-project"
+	ApprovalSourcePolicy                ApprovalSource = "policy"
+	ApprovalSourcePolicyDenyRule        ApprovalSource = "policy-deny-rule"
+	ApprovalSourceCLI                   ApprovalSource = "cli"      // Added by `op-agent approve` or `deny`
+	ApprovalSourceMigrated              ApprovalSource = "migrated" // Stored before provenance tracking
+	ApprovalSourceInteractiveHour       ApprovalSource = "interactive-hour"
+	ApprovalSourceInteractiveSession    ApprovalSource = "interactive-session"
+	ApprovalSourceSession               ApprovalSource = "session"
+	ApprovalSourceInteractiveBatch      ApprovalSource = "interactive-batch"   // Approved with the prompt of another request
+	ApprovalSourceInteractiveTimeout    ApprovalSource = "interactive-timeout" // Not answered within the prompt timeout
+)
+
+// Reason for rejecting a request before it reaches command approval.
+type DenialReason string
+
+const (
+	DenialReasonMissingToken         DenialReason = "missing-token"
+	DenialReasonInvalidToken         DenialReason = "invalid-token"
+	DenialReasonSourceNotAllowed     DenialReason = "source-not-allowed"
+	DenialReasonUnknownClient        DenialReason = "unknown-client"
+	DenialReasonInvalidSignature     DenialReason = "invalid-signature"
+	DenialReasonStaleTimestamp       DenialReason = "stale-timestamp"
+	DenialReasonReplayedRequest      DenialReason = "replayed-request"
+	DenialReasonPairingRequired      DenialReason = "pairing-required"
+	DenialReasonInvalidPairing       DenialReason = "invalid-pairing-code"
+	DenialReasonInvalidHost          DenialReason = "invalid-host"
+	DenialReasonBrowserOrigin        DenialReason = "browser-origin"
+	DenialReasonBrowserFetch         DenialReason = "browser-fetch-metadata"
+	DenialReasonMissingRequestHeader DenialReason = "missing-request-header"
+	DenialReasonInvalidContentType   DenialReason = "invalid-content-type"
+	DenialReasonBodyTooLarge         DenialReason = "body-too-large"
+	DenialReasonTooManyArgs          DenialReason = "too-many-args"
+	DenialReasonArgTooLong           DenialReason = "arg-too-long"
+	DenialReasonNulByte              DenialReason = "nul-byte"
 )
 
 // Server configuration stored in ~/.config/op-agent/config.json (or `%APPDATA%/op-agent/config.json` in Windows)
 // NOTE: We use JSON instead of TOML/YAML to avoid additional dependencies and reduce attack surface.
 type Config struct {
-	ApprovedCommands [][]string `json:"approved"` // Array of command arrays to preserve argument boundaries
+	Version          int            `json:"version"`          // Schema version, see ConfigVersion
+	ApprovedCommands []CommandRule  `json:"approved"`         // Command arrays (to preserve argument boundaries) or pattern rules
+	DeniedCommands   []CommandRule  `json:"denied,omitempty"` // Take precedence over approved commands
+	Clients          []PairedClient `json:"clients,omitempty"`
+	Limits           *RequestLimits `json:"limits,omitempty"`
+	HMAC             string         `json:"hmac,omitempty"` // Set if protected with `op-agent config protect`
+
+	policy *Policy // System policy, never saved to the user config
 }
 
 // Command request log entry.
 type CommandRequestLogEntry struct {
-	Timestamp string         `json:"timestamp"`
-	Args      []string       `json:"args"`
-	Approved  bool           `json:"approved"`
-	Source    ApprovalSource `json:"source"`
+	Timestamp string          `json:"timestamp"`
+	Args      []string        `json:"args"`
+	Command   string          `json:"command,omitempty"` // Parsed subcommand path, i.e., `item get`
+	Vault     string          `json:"vault,omitempty"`
+	Item      string          `json:"item,omitempty"`
+	Approved  bool            `json:"approved"`
+	Source    ApprovalSource  `json:"source"`
+	Client    Caller          `json:"client,omitempty"`
+	Project   *ProjectContext `json:"project,omitempty"`
+}
+
+// Rejected request log entry.
+type DeniedRequestLogEntry struct {
+	Timestamp string       `json:"timestamp"`
+	Remote    string       `json:"remote"`
+	Path      string       `json:"path"`
+	Reason    DenialReason `json:"reason"`
 }
 
 // Command log entry.
@@ -44,29 +101,64 @@ type CommandLogEntry struct {
 }
 
 func GetConfigDir() (string, error) {
-	var configDir string
+	configDir, err := getConfigDirPath()
+	if err != nil {
+		return "", err
+	}
+
+	// Ensure directory exists
+	if err := os.MkdirAll(configDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create config directory: %v", err)
+	}
+
+	return configDir, nil
+}
+
+func GetConfigPath() (string, error) {
+	configDir, err := GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "config.json"), nil
+}
 
+func getConfigDirPath() (string, error) {
 	if runtime.GOOS == "windows" {
 		appData := os.Getenv("APPDATA")
 		if appData == "" {
 			return "", fmt.Errorf("APPDATA environment variable not set")
 		}
-		configDir = filepath.Join(appData, "op-agent")
-	} else {
-		// macOS and Linux
-		home := os.Getenv("HOME")
-		if home == "" {
-			return "", fmt.Errorf("HOME environment variable not set")
-		}
-		configDir = filepath.Join(home, ".config", "op-agent")
+		return filepath.Join(appData, "op-agent"), nil
+	}
+
+	// macOS and Linux
+	home := os.Getenv("HOME")
+	if home == "" {
+		return "", fmt.Errorf("HOME environment variable not set")
+	}
+	return filepath.Join(home, ".config", "op-agent"), nil
+}
+
+// Returns the directory for the state that must stay outside the config
+// directory, which containers may have mounted: ~/.local/share/op-agent on
+// macOS and Linux, and %LOCALAPPDATA%\op-agent on Windows.
+func GetStateDir() (string, error) {
+	if runtime.GOOS != "windows" {
+		return GetLogDir()
+	}
+
+	localAppData := os.Getenv("LOCALAPPDATA")
+	if localAppData == "" {
+		return "", fmt.Errorf("LOCALAPPDATA environment variable not set")
 	}
+	stateDir := filepath.Join(localAppData, "op-agent")
 
 	// Ensure directory exists
-	if err := os.MkdirAll(configDir, 0700); err != nil {
-		return "", fmt.Errorf("failed to create config directory: %v", err)
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create state directory: %v", err)
 	}
 
-	return configDir, nil
+	return stateDir, nil
 }
 
 func GetLogDir() (string, error) {
@@ -95,15 +187,94 @@ func GetLogDir() (string, error) {
 	return logDir, nil
 }
 
+// Serializes config updates within the process. Other processes, i.e., the
+// CLI while the server runs, are serialized by the config file lock.
+var configMutex sync.Mutex
+
+// Locks the config for a load-modify-save, returning the unlock function.
+func lockConfig(configPath string) (func(), error) {
+	configMutex.Lock()
+	lock, err := lockFile(configPath + ".lock")
+	if err != nil {
+		configMutex.Unlock()
+		return nil, err
+	}
+	return func() {
+		lock.unlock()
+		configMutex.Unlock()
+	}, nil
+}
+
 func LoadConfig() (*Config, error) {
-	configDir, err := GetConfigDir()
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return nil, err
+	}
+
+	// Loading can save a migrated or normalized config
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return loadConfig(configPath)
+}
+
+// Loads the config, applies the update and saves it while holding the lock,
+// so concurrent requests and CLI commands don't lose each other's changes.
+// The config isn't saved if the update returns an error.
+func UpdateConfig(update func(config *Config) error) error {
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	if err := update(config); err != nil {
+		return err
+	}
+
+	return config.saveConfig(configPath)
+}
+
+func loadConfig(configPath string) (*Config, error) {
+	return loadConfigChecked(configPath, true)
+}
+
+// Loads the config without verifying the HMAC, to accept changes made
+// outside op-agent.
+func loadConfigUnverified(configPath string) (*Config, error) {
+	return loadConfigChecked(configPath, false)
+}
+
+func loadConfigChecked(configPath string, verify bool) (*Config, error) {
+	policy, err := LoadPolicy()
 	if err != nil {
 		return nil, err
 	}
 
-	configPath := filepath.Join(configDir, "config.json")
+	// Refuse a config that a container or another user could have modified
+	if err := checkPermissions(filepath.Dir(configPath), false); err != nil {
+		return nil, err
+	}
+	if err := checkPermissions(configPath, false); err != nil {
+		return nil, err
+	}
+
 	config := &Config{
-		ApprovedCommands: [][]string{},
+		ApprovedCommands: []CommandRule{},
+		policy:           policy,
 	}
 
 	data, err := os.ReadFile(configPath)
@@ -115,48 +286,210 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("failed to read config file: %v", err)
 	}
 
-	if err := json.Unmarshal(data, config); err != nil {
+	// Upgrade configs stored by older versions, keeping a backup as they
+	// can't read the migrated file
+	migratedData, version, err := MigrateConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config file: %v", err)
+	}
+	migrated := version < ConfigVersion
+	if migrated {
+		if err := WriteFileAtomic(fmt.Sprintf("%s.v%d.bak", configPath, version), data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to back up config file: %v", err)
+		}
+	}
+
+	if err := json.Unmarshal(migratedData, config); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %v", err)
 	}
 
+	if verify {
+		key, err := loadIntegrityKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := config.verifyIntegrity(configPath, key); err != nil {
+			return nil, err
+		}
+	}
+
+	// Migrate rules stored before canonical matching
+	approvedChanged := false
+	config.ApprovedCommands, approvedChanged = normalizeRules(config.ApprovedCommands)
+	deniedChanged := false
+	config.DeniedCommands, deniedChanged = normalizeRules(config.DeniedCommands)
+
+	// Clean up expired and used up rules
+	pruned := config.pruneInactiveRules(time.Now())
+
+	if approvedChanged || deniedChanged || pruned || migrated {
+		if err := config.saveConfig(configPath); err != nil {
+			return nil, fmt.Errorf("failed to save normalized config: %v", err)
+		}
+	}
+
 	return config, nil
 }
 
-func (c *Config) SaveConfig() error {
-	configDir, err := GetConfigDir()
+// Rewrites rules in the canonical form and drops duplicates, returning true
+// if anything changed.
+func normalizeRules(rules []CommandRule) ([]CommandRule, bool) {
+	if rules == nil {
+		return nil, false
+	}
+
+	changed := false
+	normalized := make([]CommandRule, 0, len(rules))
+
+	for _, approved := range rules {
+		// Copy the rule to keep the metadata
+		rule := approved
+		rule.Args = CanonicalArgs(approved.Args)
+		if approved.Pattern {
+			patternRule, err := NewPatternRule(approved.Args)
+			if err != nil {
+				// Keep invalid patterns as-is, they never match
+				normalized = append(normalized, approved)
+				continue
+			}
+			rule.Args = patternRule.Args
+		}
+
+		if !commandsEqual(rule.Args, approved.Args) {
+			changed = true
+		}
+
+		duplicate := false
+		for _, existing := range normalized {
+			if existing.Identical(rule) {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			changed = true
+			continue
+		}
+
+		normalized = append(normalized, rule)
+	}
+
+	return normalized, changed
+}
+
+func (c *Config) saveConfig(configPath string) error {
+	c.Version = ConfigVersion
+
+	key, err := loadIntegrityKey()
 	if err != nil {
 		return err
 	}
+	if err := c.sign(key); err != nil {
+		return err
+	}
 
-	configPath := filepath.Join(configDir, "config.json")
 	data, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %v", err)
 	}
 
-	if err := os.WriteFile(configPath, data, 0600); err != nil {
+	if err := WriteFileAtomic(configPath, data, 0600); err != nil {
 		return fmt.Errorf("failed to write config file: %v", err)
 	}
 
 	return nil
 }
 
-func (c *Config) IsCommandApproved(args []string) bool {
-	for _, approved := range c.ApprovedCommands {
-		if commandsEqual(approved, args) {
-			return true
+// Checks if the command is approved for the requester by an exact or
+// pattern rule of the user config or the system policy. Commands are
+// compared in the canonical form, so flag order and syntax variations match
+// the same approval. Rules scoped to other callers or projects are skipped.
+func (c *Config) IsCommandApproved(args []string, requester Requester) bool {
+	return c.FindApprovedRule(args, requester) != nil || c.IsCommandApprovedByPolicy(args, requester)
+}
+
+// Returns the first active approval rule of the user config matching the
+// command, or nil.
+func (c *Config) FindApprovedRule(args []string, requester Requester) *CommandRule {
+	return findRule(c.ApprovedCommands, args, requester, time.Now())
+}
+
+// Adds the approval rule, returning false if an identical one exists.
+func (c *Config) AddApprovedRule(rule CommandRule) bool {
+	var added bool
+	c.ApprovedCommands, added = addRule(c.ApprovedCommands, rule)
+	return added
+}
+
+// Checks if the command matches an active deny rule of the user config or
+// the system policy for the requester.
+func (c *Config) IsCommandDenied(args []string, requester Requester) bool {
+	return c.IsCommandDeniedByPolicy(args, requester) || findDenyRule(c.DeniedCommands, args, requester, time.Now()) != nil
+}
+
+// Adds the deny rule, returning false if an identical one exists.
+func (c *Config) AddDeniedRule(rule CommandRule) bool {
+	var added bool
+	c.DeniedCommands, added = addRule(c.DeniedCommands, rule)
+	return added
+}
+
+func findRule(rules []CommandRule, args []string, requester Requester, now time.Time) *CommandRule {
+	for i := range rules {
+		if rules[i].Active(now) && rules[i].AppliesTo(requester) && rules[i].Matches(args) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// Finds the deny rule for the command, failing closed on commands that
+// can't be canonicalized.
+func findDenyRule(rules []CommandRule, args []string, requester Requester, now time.Time) *CommandRule {
+	for i := range rules {
+		if rules[i].Active(now) && rules[i].AppliesTo(requester) && rules[i].Denies(args) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// Adds the rule, replacing one with the same arguments and scope but
+// different metadata, i.e., to extend an expiring approval.
+func addRule(rules []CommandRule, rule CommandRule) ([]CommandRule, bool) {
+	for i := range rules {
+		if rules[i].Identical(rule) {
+			return rules, false
+		}
+		if rules[i].sameScope(rule) {
+			rules[i] = rule
+			return rules, true
 		}
 	}
-	return false
+	return append(rules, rule), true
+}
+
+// Drops expired and used up rules, returning true if any were removed.
+func (c *Config) pruneInactiveRules(now time.Time) bool {
+	approvedPruned := false
+	c.ApprovedCommands, approvedPruned = pruneRules(c.ApprovedCommands, now)
+	deniedPruned := false
+	c.DeniedCommands, deniedPruned = pruneRules(c.DeniedCommands, now)
+	return approvedPruned || deniedPruned
 }
 
-func (c *Config) AddApprovedCommand(args []string) {
-	if !c.IsCommandApproved(args) {
-		// Make a copy to avoid slice aliasing issues
-		cmdCopy := make([]string, len(args))
-		copy(cmdCopy, args)
-		c.ApprovedCommands = append(c.ApprovedCommands, cmdCopy)
+func pruneRules(rules []CommandRule, now time.Time) ([]CommandRule, bool) {
+	if rules == nil {
+		return nil, false
 	}
+
+	active := make([]CommandRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Active(now) {
+			active = append(active, rule)
+		}
+	}
+	return active, len(active) != len(rules)
 }
 
 func commandsEqual(a, b []string) bool {
@@ -171,19 +504,35 @@ func commandsEqual(a, b []string) bool {
 	return true
 }
 
-func LogCommandRequest(args []string, approved bool, source ApprovalSource) error {
+func LogCommandRequest(args []string, approved bool, source ApprovalSource, requester Requester) error {
+	opCmd := ParseOpCommand(args)
 	logEntry := CommandRequestLogEntry{
 		Timestamp: time.Now().Format(time.RFC3339),
 		Args:      args,
+		Command:   opCmd.Name(),
+		Vault:     opCmd.Vault(),
+		Item:      opCmd.Item(),
 		Approved:  approved,
 		Source:    source,
+		Client:    requester.Caller,
+	}
+	if !requester.Project.IsEmpty() {
+		logEntry.Project = &requester.Project
 	}
 
 	approvedStr := "🔴 Denied:"
+	switch logEntry.Source {
+	case ApprovalSourceDenyRule, ApprovalSourcePolicyDenyRule, ApprovalSourceInteractiveNever, ApprovalSourceInteractiveTimeout:
+		approvedStr = fmt.Sprintf("🔴 Denied via %s:", logEntry.Source)
+	}
 	if approved {
 		approvedStr = fmt.Sprintf("🟢 Approved via %s:", logEntry.Source)
 	}
-	fmt.Printf("[%s] %s op %s\n", logEntry.Timestamp, approvedStr, strings.Join(logEntry.Args, " "))
+	from := requester.Caller.Short()
+	if key := requester.Project.Key(); key != "" {
+		from += ", " + QuoteArg(key)
+	}
+	fmt.Printf("[%s] %s op %s (%s)\n", logEntry.Timestamp, approvedStr, FormatArgs(logEntry.Args), from)
 
 	logEntryBytes, err := json.Marshal(logEntry)
 	if err != nil {
@@ -205,7 +554,30 @@ func LogCommand(args []string, exit int) error {
 		Exit:      exit,
 	}
 
-	fmt.Printf("[%s] EXECUTED (exit code %d) op %s\n", logEntry.Timestamp, logEntry.Exit, strings.Join(logEntry.Args, " "))
+	fmt.Printf("[%s] EXECUTED (exit code %d) op %s\n", logEntry.Timestamp, logEntry.Exit, FormatArgs(logEntry.Args))
+
+	logEntryBytes, err := json.Marshal(logEntry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal log entry: %v", err)
+	}
+
+	err = LogEntry(logEntryBytes)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func LogDeniedRequest(remote string, path string, reason DenialReason) error {
+	logEntry := DeniedRequestLogEntry{
+		Timestamp: time.Now().Format(time.RFC3339),
+		Remote:    remote,
+		Path:      path,
+		Reason:    reason,
+	}
+
+	fmt.Printf("[%s] 🔴 Rejected %s request from %s: %s\n", logEntry.Timestamp, logEntry.Path, logEntry.Remote, logEntry.Reason)
 
 	logEntryBytes, err := json.Marshal(logEntry)
 	if err != nil {
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Control channel paths, served on the control socket.
+const (
+	ControlPathPending = "/pending" // Lists the pending requests
+	ControlPathAnswer  = "/answer"  // Answers a pending request
+)
+
+// Control socket file name pattern, with the PID of the agent.
+const controlSocketPattern = "control-%d.sock"
+
+// Returns the path of the control socket of the agent with the PID, used by
+// `op-agent pending`. It's kept in the state directory, so a container with
+// the config directory mounted can't approve its own requests. Each agent
+// has its own socket, so several can run at once.
+func GetControlSocketPath(pid int) (string, error) {
+	stateDir, err := GetStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, fmt.Sprintf(controlSocketPattern, pid)), nil
+}
+
+// Control socket of a running agent.
+type ControlSocket struct {
+	PID  int
+	Path string
+}
+
+// Finds the control sockets of the running agents, removing the stale ones
+// left by crashed agents.
+func FindControlSockets() ([]ControlSocket, error) {
+	stateDir, err := GetStateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(stateDir, "control-*.sock"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find control sockets: %v", err)
+	}
+
+	var sockets []ControlSocket
+	for _, path := range paths {
+		var pid int
+		if _, err := fmt.Sscanf(filepath.Base(path), controlSocketPattern, &pid); err != nil {
+			continue
+		}
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err != nil {
+			if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+				os.Remove(path)
+			}
+			continue
+		}
+		conn.Close()
+		sockets = append(sockets, ControlSocket{PID: pid, Path: path})
+	}
+	return sockets, nil
+}
+
+// Request waiting for approval.
+type PendingRequest struct {
+	ID         int             `json:"id"`
+	Args       []string        `json:"args"`
+	Client     Caller          `json:"client"`
+	ClientName string          `json:"client_name,omitempty"` // Of paired clients
+	Project    *ProjectContext `json:"project,omitempty"`
+	QueuedAt   string          `json:"queued_at"`            // RFC 3339
+	ExpiresAt  string          `json:"expires_at,omitempty"` // RFC 3339, denied after
+}
+
+// Answer to a pending request, one of the prompt options: once, hour,
+// session, always, project, everywhere, never or no.
+type PendingAnswer struct {
+	ID     int    `json:"id"`
+	Answer string `json:"answer"`
+}
+
+// Returns an HTTP client that connects to the control socket.
+func NewControlClient(path string) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", path)
+	}
+	return &http.Client{Transport: transport}
+}
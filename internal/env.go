@@ -1,9 +1,13 @@
 package internal
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
 )
 
 const AgentPortEnvName = "OP_AGENT_PORT"
@@ -33,18 +37,90 @@ func GetAgentHost(inContainer bool) string {
 	return GetEnvOr(AgentHostEnvName, defaultHost)
 }
 
+const (
+	AgentTokenEnvName     = "OP_AGENT_TOKEN"
+	AgentTokenFileEnvName = "OP_AGENT_TOKEN_FILE"
+)
+
+const AgentClientKeyFileEnvName = "OP_AGENT_CLIENT_KEY_FILE"
+
+const AgentContainerIDEnvName = "OP_AGENT_CONTAINER_ID"
+
+const (
+	AgentCAFileEnvName        = "OP_AGENT_CA_FILE"
+	AgentCAFingerprintEnvName = "OP_AGENT_CA_FINGERPRINT"
+)
+
+// Checks if the client is configured to connect over HTTPS.
+func IsAgentTLS() bool {
+	return os.Getenv(AgentCAFileEnvName) != "" || os.Getenv(AgentCAFingerprintEnvName) != ""
+}
+
 type AgentCommand string
 
 const (
 	AgentCommandOp        AgentCommand = "op"
 	AgentCommandHandshake AgentCommand = "handshake"
+	AgentCommandPair      AgentCommand = "pair"
 )
 
+const agentSocketScheme = "unix://"
+
+// Returns the socket path when OP_AGENT_HOST uses the unix:// scheme, i.e.,
+// `OP_AGENT_HOST=unix:///run/op-agent.sock`.
+func GetAgentSocket(inContainer bool) (string, bool) {
+	path, ok := strings.CutPrefix(GetAgentHost(inContainer), agentSocketScheme)
+	return path, ok && path != ""
+}
+
+// Returns the human-readable agent address for messages.
+func GetAgentAddress(inContainer bool) string {
+	if socket, ok := GetAgentSocket(inContainer); ok {
+		return agentSocketScheme + socket
+	}
+	return fmt.Sprintf("%s:%d", GetAgentHost(inContainer), GetAgentPort())
+}
+
 func GetAgentURL(inContainer bool, command AgentCommand) string {
+	scheme := "http"
+	if IsAgentTLS() {
+		scheme = "https"
+	}
+
+	// Requests over a socket still need an HTTP URL, the host is ignored by the dialer
+	if _, ok := GetAgentSocket(inContainer); ok {
+		return fmt.Sprintf("%s://localhost/%s", scheme, command)
+	}
+
 	host := GetAgentHost(inContainer)
 	port := GetAgentPort()
 
-	return fmt.Sprintf("http://%s:%d/%s", host, port, command)
+	return fmt.Sprintf("%s://%s:%d/%s", scheme, host, port, command)
+}
+
+// Returns an HTTP client that connects to the agent over TCP or Unix socket,
+// using TLS with the pinned CA when configured.
+func NewAgentClient(inContainer bool) (*http.Client, error) {
+	tlsConfig, err := GetClientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	socket, isSocket := GetAgentSocket(inContainer)
+	if !isSocket && tlsConfig == nil {
+		return http.DefaultClient, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if isSocket {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+
+	return &http.Client{Transport: transport}, nil
 }
 
 func GetEnvOr(key, defaultVal string) string {
@@ -0,0 +1,43 @@
+//go:build !windows
+
+package internal
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Advisory lock held on a file next to the locked one, shared between the
+// server and the CLI.
+type fileLock struct {
+	file *os.File
+}
+
+// Blocks until the exclusive lock on the path is acquired.
+func lockFile(path string) (*fileLock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+
+	return &fileLock{file: file}, nil
+}
+
+// The lock file is kept, as removing it would let another process lock a
+// new file while the old one is still held.
+func (l *fileLock) unlock() {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
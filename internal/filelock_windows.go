@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	lockRetryInterval = 50 * time.Millisecond
+	lockTimeout       = 10 * time.Second
+	// Lock files older than this are left by crashed processes, as the lock
+	// is held only for a load-modify-save
+	lockStaleAge = 30 * time.Second
+)
+
+// Lock file created exclusively, shared between the server and the CLI.
+type fileLock struct {
+	path string
+	file *os.File
+}
+
+// Blocks until the lock file is created or the timeout passes.
+func lockFile(path string) (*fileLock, error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+		if err == nil {
+			return &fileLock{path: path, file: file}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create lock file: %v", err)
+		}
+
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > lockStaleAge {
+			os.Remove(path)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for the lock %s, remove it if no op-agent is running", path)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+func (l *fileLock) unlock() {
+	l.file.Close()
+	os.Remove(l.path)
+}
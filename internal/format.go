@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Formats the arguments for display with shell-style quoting, so argument
+// boundaries are visible and control characters can't spoof the output.
+func FormatArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = QuoteArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Quotes the argument like a POSIX shell would need it. Arguments with
+// control or invisible characters use ANSI-C quoting ($'...') with escapes.
+func QuoteArg(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+
+	if isShellSafe(arg) {
+		return arg
+	}
+
+	if !hasUnsafeRunes(arg) {
+		return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+
+	var b strings.Builder
+	b.WriteString("$'")
+	for i, r := range arg {
+		switch {
+		case r == utf8.RuneError && !strings.HasPrefix(arg[i:], "�"):
+			fmt.Fprintf(&b, `\x%02x`, arg[i])
+		case r == '\'' || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == 0x1b:
+			b.WriteString(`\e`)
+		case r < 0x80 && isUnsafeRune(r):
+			fmt.Fprintf(&b, `\x%02x`, r)
+		case isUnsafeRune(r):
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteString("'")
+	return b.String()
+}
+
+func isShellSafe(arg string) bool {
+	for _, r := range arg {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./_-", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Control characters, including ANSI escapes, and invisible format characters
+// like zero-width spaces and bidirectional overrides.
+func isUnsafeRune(r rune) bool {
+	return unicode.IsControl(r) || unicode.Is(unicode.Cf, r) || r == utf8.RuneError
+}
+
+func hasUnsafeRunes(arg string) bool {
+	if !utf8.ValidString(arg) {
+		return true
+	}
+	for _, r := range arg {
+		if isUnsafeRune(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns human-readable warnings about arguments that may visually spoof
+// the command, i.e., with control characters or leading spaces.
+func ArgWarnings(args []string) []string {
+	var warnings []string
+
+	for i, arg := range args {
+		warnings = append(warnings, textWarnings(fmt.Sprintf("Argument %d", i+1), arg)...)
+	}
+
+	return warnings
+}
+
+// Returns warnings about the paired client name that may spoof the prompt.
+// Names are validated when pairing, but the config could be edited since.
+func ClientNameWarnings(name string) []string {
+	return textWarnings("Client name", name)
+}
+
+func textWarnings(label string, value string) []string {
+	var warnings []string
+
+	switch {
+	case strings.ContainsRune(value, 0x1b):
+		warnings = append(warnings, label+" contains terminal escape sequences")
+	case strings.ContainsAny(value, "\r\n"):
+		warnings = append(warnings, label+" contains line breaks")
+	case hasUnsafeRunes(value):
+		warnings = append(warnings, label+" contains control or invisible characters")
+	}
+
+	if value != strings.TrimSpace(value) {
+		warnings = append(warnings, label+" has leading or trailing whitespace")
+	}
+
+	return warnings
+}
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const integrityKeyBytes = 32
+
+// Returns the path of the key for the config HMAC. It's kept in the state
+// directory, so a container that can write the config can't re-sign it.
+func GetIntegrityKeyPath() (string, error) {
+	stateDir, err := GetStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, "config.key"), nil
+}
+
+// Reads the HMAC key, returning nil if the config isn't protected.
+func loadIntegrityKey() ([]byte, error) {
+	keyPath, err := GetIntegrityKeyPath()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range []string{filepath.Dir(keyPath), keyPath} {
+		if err := checkPermissions(path, false); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read config key: %v", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != integrityKeyBytes {
+		return nil, fmt.Errorf("invalid config key %s", keyPath)
+	}
+	return key, nil
+}
+
+// Generates the HMAC key if there's none, enabling the integrity check.
+func createIntegrityKey() error {
+	keyPath, err := GetIntegrityKeyPath()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(keyPath); err == nil {
+		return nil
+	}
+
+	key := make([]byte, integrityKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate config key: %v", err)
+	}
+
+	if err := WriteFileAtomic(keyPath, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write config key: %v", err)
+	}
+	return nil
+}
+
+// Computes the HMAC over everything that grants access: the rules, the
+// paired clients and the limits.
+func (c *Config) computeHMAC(key []byte) (string, error) {
+	signed := *c
+	signed.HMAC = ""
+	data, err := json.Marshal(&signed)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal config: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Verifies the config HMAC if the config is protected.
+func (c *Config) verifyIntegrity(configPath string, key []byte) error {
+	if key == nil {
+		return nil
+	}
+
+	expected, err := c.computeHMAC(key)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal([]byte(expected), []byte(c.HMAC)) {
+		return fmt.Errorf("🚨 INTEGRITY CHECK FAILED: %s was modified outside op-agent and may contain approvals added by a container. Review it, then run 'op-agent config protect' to accept the changes", configPath)
+	}
+	return nil
+}
+
+// Signs the config if it's protected.
+func (c *Config) sign(key []byte) error {
+	if key == nil {
+		c.HMAC = ""
+		return nil
+	}
+
+	signature, err := c.computeHMAC(key)
+	if err != nil {
+		return err
+	}
+	c.HMAC = signature
+	return nil
+}
+
+// Enables the config HMAC, or accepts the changes made outside op-agent,
+// signing the config as it is.
+func ProtectConfig() error {
+	if err := createIntegrityKey(); err != nil {
+		return err
+	}
+
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	config, err := loadConfigUnverified(configPath)
+	if err != nil {
+		return err
+	}
+	return config.saveConfig(configPath)
+}
+
+// Disables the config HMAC, removing the key and the signature.
+func UnprotectConfig() error {
+	keyPath, err := GetIntegrityKeyPath()
+	if err != nil {
+		return err
+	}
+
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Load first, so a tampered config isn't accepted by disabling the check
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove config key: %v", err)
+	}
+	return config.saveConfig(configPath)
+}
+
+// Checks if the config is protected by an HMAC.
+func IsConfigProtected() (bool, error) {
+	key, err := loadIntegrityKey()
+	return key != nil, err
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Request limits configured in config.json. Zero values fall back to defaults.
+type RequestLimits struct {
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+	MaxArgs      int   `json:"max_args,omitempty"`
+	MaxArgLength int   `json:"max_arg_length,omitempty"`
+}
+
+const (
+	DefaultMaxBodyBytes = 64 * 1024
+	DefaultMaxArgs      = 64
+	DefaultMaxArgLength = 4096
+)
+
+// Returns the configured request limits with defaults applied, capped by the
+// system policy.
+func (c *Config) GetLimits() RequestLimits {
+	limits := RequestLimits{
+		MaxBodyBytes: DefaultMaxBodyBytes,
+		MaxArgs:      DefaultMaxArgs,
+		MaxArgLength: DefaultMaxArgLength,
+	}
+
+	if c.Limits == nil {
+		return c.policy.capLimits(limits)
+	}
+	if c.Limits.MaxBodyBytes > 0 {
+		limits.MaxBodyBytes = c.Limits.MaxBodyBytes
+	}
+	if c.Limits.MaxArgs > 0 {
+		limits.MaxArgs = c.Limits.MaxArgs
+	}
+	if c.Limits.MaxArgLength > 0 {
+		limits.MaxArgLength = c.Limits.MaxArgLength
+	}
+	return c.policy.capLimits(limits)
+}
+
+// Request validation error returned to the client.
+type ValidationError struct {
+	Code    ErrorCode
+	Reason  DenialReason // Logged for the rejected request
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// Checks the command arguments against the limits and rejects NUL bytes,
+// which can't be passed to a process and would be silently truncated.
+func ValidateArgs(args []string, limits RequestLimits) *ValidationError {
+	if len(args) > limits.MaxArgs {
+		return &ValidationError{
+			Code:    ErrorCodeTooManyArgs,
+			Reason:  DenialReasonTooManyArgs,
+			Message: fmt.Sprintf("too many arguments: %d, maximum is %d", len(args), limits.MaxArgs),
+		}
+	}
+
+	for i, arg := range args {
+		if len(arg) > limits.MaxArgLength {
+			return &ValidationError{
+				Code:    ErrorCodeArgTooLong,
+				Reason:  DenialReasonArgTooLong,
+				Message: fmt.Sprintf("argument %d is too long: %d bytes, maximum is %d", i+1, len(arg), limits.MaxArgLength),
+			}
+		}
+
+		if strings.ContainsRune(arg, 0) {
+			return &ValidationError{
+				Code:    ErrorCodeNulByte,
+				Reason:  DenialReasonNulByte,
+				Message: fmt.Sprintf("argument %d contains a NUL byte", i+1),
+			}
+		}
+	}
+
+	return nil
+}
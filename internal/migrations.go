@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Current config.json schema version. Bump it together with a new migration
+// in configMigrations whenever the format changes.
+const ConfigVersion = 1
+
+// Config schema migration, upgrading the raw config from the previous version.
+type configMigration struct {
+	version int // Version the config is at after the migration
+	migrate func(raw map[string]json.RawMessage) error
+}
+
+// Ordered list of the migrations, one per version.
+var configMigrations = []configMigration{
+	{version: 1, migrate: migrateRulesToObjects},
+}
+
+// Upgrades the config data to the current version, returning the migrated
+// data and the version it was stored with. Configs written by a newer agent
+// are refused, as saving them would drop what this version doesn't know.
+func MigrateConfig(data []byte) ([]byte, int, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, 0, err
+	}
+
+	version, err := configVersion(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version > ConfigVersion {
+		return nil, version, fmt.Errorf("the config version %d is newer than the supported version %d, upgrade op-agent", version, ConfigVersion)
+	}
+	if version == ConfigVersion {
+		return data, version, nil
+	}
+
+	for _, migration := range configMigrations {
+		if migration.version <= version {
+			continue
+		}
+		if err := migration.migrate(raw); err != nil {
+			return nil, version, fmt.Errorf("failed to migrate config to version %d: %v", migration.version, err)
+		}
+	}
+
+	raw["version"], _ = json.Marshal(ConfigVersion)
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, version, err
+	}
+	return migrated, version, nil
+}
+
+// Reads the config version, missing in configs stored before versioning.
+func configVersion(raw map[string]json.RawMessage) (int, error) {
+	value, ok := raw["version"]
+	if !ok {
+		return 0, nil
+	}
+	var version int
+	if err := json.Unmarshal(value, &version); err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid config version %s", value)
+	}
+	return version, nil
+}
+
+// Version 1: converts rules stored as plain strings (before v0.2.2) and
+// argument arrays to objects that track provenance.
+func migrateRulesToObjects(raw map[string]json.RawMessage) error {
+	for _, key := range []string{"approved", "denied"} {
+		value, ok := raw[key]
+		if !ok || bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+			continue
+		}
+
+		var rules []json.RawMessage
+		if err := json.Unmarshal(value, &rules); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+
+		for i, rule := range rules {
+			var args []string
+			switch bytes.TrimSpace(rule)[0] {
+			case '"':
+				// Argument boundaries were already lost when the string was stored
+				var command string
+				if err := json.Unmarshal(rule, &command); err != nil {
+					return fmt.Errorf("%s rule #%d: %v", key, i+1, err)
+				}
+				args = strings.Fields(command)
+			case '[':
+				if err := json.Unmarshal(rule, &args); err != nil {
+					return fmt.Errorf("%s rule #%d: %v", key, i+1, err)
+				}
+			default:
+				continue
+			}
+
+			migrated, err := json.Marshal(commandRuleObject{Args: args, Source: ApprovalSourceMigrated})
+			if err != nil {
+				return err
+			}
+			rules[i] = migrated
+		}
+
+		data, err := json.Marshal(rules)
+		if err != nil {
+			return err
+		}
+		raw[key] = data
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Interface name prefixes of Docker and Podman bridge networks.
+var bridgeInterfacePrefixes = []string{"docker", "br-", "podman", "cni-podman"}
+
+var loopbackNetworks = []string{"127.0.0.0/8", "::1/128"}
+
+// Parses CIDR notations or single IP addresses into networks.
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", value)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", value, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// Returns loopback and the local Docker/Podman bridge networks. Bridges are
+// detected on each call as they can appear after the agent starts.
+func DefaultAllowedNetworks() []*net.IPNet {
+	networks, _ := ParseNetworks(loopbackNetworks)
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return networks
+	}
+
+	for _, iface := range interfaces {
+		if !isBridgeInterface(iface.Name) {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if network, ok := addr.(*net.IPNet); ok {
+				networks = append(networks, &net.IPNet{IP: network.IP.Mask(network.Mask), Mask: network.Mask})
+			}
+		}
+	}
+
+	return networks
+}
+
+func isBridgeInterface(name string) bool {
+	for _, prefix := range bridgeInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the remote address (host:port) belongs to one of the networks.
+func IsAddressAllowed(remoteAddr string, networks []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,410 @@
+package internal
+
+import (
+	"sort"
+	"strings"
+)
+
+// Parsed 1Password CLI command, i.e., `item get X --vault Y` becomes path
+// `item get`, positional arg `X` and flag `vault=Y`.
+type OpCommand struct {
+	Path        []string // Subcommand path, i.e., `item get`
+	GlobalFlags []OpFlag
+	Flags       []OpFlag
+	Args        []string // Positional arguments
+	Passthrough []string // Arguments after `--`, i.e., the program for `op run`
+	SecretRefs  []SecretRef
+	// Flags unknown to the parser. Their values can't be told apart from
+	// positional arguments, so the parse is ambiguous.
+	UnknownFlags []string
+}
+
+type OpFlag struct {
+	Name     string // Long name without dashes
+	Value    string
+	HasValue bool
+}
+
+// Secret reference, i.e., `op://vault/item/section/field`.
+type SecretRef struct {
+	Raw     string
+	Vault   string
+	Item    string
+	Section string
+	Field   string
+}
+
+const secretRefPrefix = "op://"
+
+// Subcommands of the op CLI by parent path.
+var opCommandTree = map[string][]string{
+	"":                  {"account", "connect", "document", "events-api", "group", "item", "plugin", "service-account", "user", "vault", "completion", "inject", "read", "run", "signin", "signout", "update", "whoami"},
+	"account":           {"add", "edit", "forget", "get", "list"},
+	"connect":           {"group", "server", "token", "vault"},
+	"connect group":     {"grant", "revoke"},
+	"connect server":    {"create", "delete", "edit", "get", "list"},
+	"connect token":     {"create", "delete", "edit", "list"},
+	"connect vault":     {"grant", "revoke"},
+	"document":          {"create", "delete", "edit", "get", "list"},
+	"events-api":        {"create"},
+	"group":             {"create", "delete", "edit", "get", "list", "user"},
+	"group user":        {"grant", "list", "revoke"},
+	"item":              {"create", "delete", "edit", "get", "list", "move", "share", "template"},
+	"item template":     {"get", "list"},
+	"plugin":            {"clear", "credential", "init", "inspect", "list", "run"},
+	"plugin credential": {"import"},
+	"service-account":   {"create", "ratelimit"},
+	"user":              {"confirm", "delete", "edit", "get", "list", "provision", "reactivate", "recover", "suspend"},
+	"vault":             {"create", "delete", "edit", "get", "group", "list", "user"},
+	"vault group":       {"grant", "list", "revoke"},
+	"vault user":        {"grant", "list", "revoke"},
+}
+
+// Subcommand aliases accepted by op, i.e., `item rm` for `item delete`.
+var opSubcommandAliases = map[string]string{
+	"ls":     "list",
+	"remove": "delete",
+	"rm":     "delete",
+}
+
+// Global flags and whether they take a value.
+var opGlobalFlags = map[string]bool{
+	"account":        true,
+	"cache":          false,
+	"config":         true,
+	"debug":          false,
+	"encoding":       true,
+	"format":         true,
+	"help":           false,
+	"iso-timestamps": false,
+	"no-color":       false,
+	"session":        true,
+	"version":        false,
+}
+
+// Command flags and whether they take a value. Flags with optional values
+// (i.e., `--generate-password`) are treated as boolean unless `--flag=value`.
+var opCommandFlags = map[string]bool{
+	"address":                true,
+	"all":                    false,
+	"allow-admins-to-manage": true,
+	"archive":                false,
+	"can-create-vaults":      true,
+	"categories":             true,
+	"category":               true,
+	"description":            true,
+	"dry-run":                false,
+	"email":                  true,
+	"emails":                 true,
+	"env-file":               true,
+	"expires-in":             true,
+	"expiry":                 true,
+	"favorite":               false,
+	"fields":                 true,
+	"file-name":              true,
+	"force":                  false,
+	"generate-password":      false,
+	"group":                  true,
+	"icon":                   true,
+	"in-file":                true,
+	"include-archive":        false,
+	"item":                   true,
+	"language":               true,
+	"long":                   false,
+	"name":                   true,
+	"no-masking":             false,
+	"no-newline":             false,
+	"otp":                    false,
+	"out-file":               true,
+	"permissions":            true,
+	"raw":                    false,
+	"reveal":                 false,
+	"role":                   true,
+	"server":                 true,
+	"shorthand":              true,
+	"ssh-generate-key":       false,
+	"tags":                   true,
+	"template":               true,
+	"title":                  true,
+	"travel-mode":            true,
+	"url":                    true,
+	"user":                   true,
+	"vault":                  true,
+	"vaults":                 true,
+	"view-once":              false,
+}
+
+// Short flag aliases.
+var opShortFlags = map[string]string{
+	"f": "force",
+	"h": "help",
+	"i": "in-file",
+	"n": "no-newline",
+	"o": "out-file",
+}
+
+// Parses the op arguments into a typed command. The parser never fails:
+// anything it doesn't recognize is kept as positional args or unknown flags.
+func ParseOpCommand(args []string) OpCommand {
+	var cmd OpCommand
+	pathKey := ""
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			cmd.Passthrough = append([]string{}, args[i+1:]...)
+			break
+		}
+
+		if len(arg) > 1 && strings.HasPrefix(arg, "-") {
+			flag, global, known, consumed := parseFlag(args, i)
+			i += consumed
+
+			if !known {
+				cmd.UnknownFlags = append(cmd.UnknownFlags, flag.Name)
+			}
+			if global {
+				cmd.GlobalFlags = append(cmd.GlobalFlags, flag)
+			} else {
+				cmd.Flags = append(cmd.Flags, flag)
+			}
+			if flag.HasValue {
+				cmd.addSecretRef(flag.Value)
+			}
+			continue
+		}
+
+		// Extend the subcommand path until the first positional argument
+		if name, ok := subcommandName(pathKey, arg); ok && len(cmd.Args) == 0 {
+			cmd.Path = append(cmd.Path, name)
+			pathKey = strings.Join(cmd.Path, " ")
+			continue
+		}
+
+		cmd.Args = append(cmd.Args, arg)
+		cmd.addSecretRef(arg)
+	}
+
+	return cmd
+}
+
+// Parses the flag at args[i], returning the number of extra consumed args.
+func parseFlag(args []string, i int) (OpFlag, bool, bool, int) {
+	arg := args[i]
+
+	var name string
+	var value string
+	hasInlineValue := false
+
+	if long, ok := strings.CutPrefix(arg, "--"); ok {
+		name, value, hasInlineValue = strings.Cut(long, "=")
+	} else {
+		short, inlineValue, hasInline := strings.Cut(arg[1:], "=")
+		name = short
+		if alias, ok := opShortFlags[short]; ok {
+			name = alias
+		}
+		value, hasInlineValue = inlineValue, hasInline
+	}
+
+	takesValue, global := opGlobalFlags[name]
+	known := global
+	if !global {
+		takesValue, known = opCommandFlags[name]
+	}
+
+	flag := OpFlag{Name: name, Value: value, HasValue: hasInlineValue}
+	if hasInlineValue || !takesValue {
+		return flag, global, known, 0
+	}
+
+	if i+1 < len(args) {
+		flag.Value = args[i+1]
+		flag.HasValue = true
+		return flag, global, known, 1
+	}
+
+	return flag, global, known, 0
+}
+
+// Returns the subcommand name with aliases resolved, and false if the
+// argument isn't a subcommand of the parent.
+func subcommandName(parent string, arg string) (string, bool) {
+	if isSubcommand(parent, arg) {
+		return arg, true
+	}
+	if name, ok := opSubcommandAliases[arg]; ok && isSubcommand(parent, name) {
+		return name, true
+	}
+	return "", false
+}
+
+func isSubcommand(parent string, name string) bool {
+	for _, subcommand := range opCommandTree[parent] {
+		if subcommand == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (cmd *OpCommand) addSecretRef(value string) {
+	if ref, ok := ParseSecretRef(value); ok {
+		cmd.SecretRefs = append(cmd.SecretRefs, ref)
+	}
+}
+
+// Parses `op://vault/item/[section/]field` references.
+func ParseSecretRef(value string) (SecretRef, bool) {
+	rest, ok := strings.CutPrefix(value, secretRefPrefix)
+	if !ok {
+		return SecretRef{}, false
+	}
+
+	// Drop query attributes, i.e., `?attribute=otp`
+	rest, _, _ = strings.Cut(rest, "?")
+
+	ref := SecretRef{Raw: value}
+	parts := strings.Split(rest, "/")
+	switch len(parts) {
+	case 4:
+		ref.Vault, ref.Item, ref.Section, ref.Field = parts[0], parts[1], parts[2], parts[3]
+	case 3:
+		ref.Vault, ref.Item, ref.Field = parts[0], parts[1], parts[2]
+	default:
+		ref.Vault = parts[0]
+		if len(parts) > 1 {
+			ref.Item = parts[1]
+		}
+	}
+	return ref, true
+}
+
+// Returns the subcommand path as a string, i.e., `item get`.
+func (cmd *OpCommand) Name() string {
+	return strings.Join(cmd.Path, " ")
+}
+
+// Returns the last value of the flag (command flags take precedence).
+func (cmd *OpCommand) Flag(name string) (string, bool) {
+	for _, flags := range [][]OpFlag{cmd.Flags, cmd.GlobalFlags} {
+		for i := len(flags) - 1; i >= 0; i-- {
+			if flags[i].Name == name {
+				return flags[i].Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Returns the vault the command targets, from --vault or a secret reference.
+func (cmd *OpCommand) Vault() string {
+	if vault, ok := cmd.Flag("vault"); ok {
+		return vault
+	}
+	if len(cmd.SecretRefs) > 0 {
+		return cmd.SecretRefs[0].Vault
+	}
+	return ""
+}
+
+// Returns the item the command targets.
+func (cmd *OpCommand) Item() string {
+	if len(cmd.Path) == 2 && (cmd.Path[0] == "item" || cmd.Path[0] == "document") && len(cmd.Args) > 0 {
+		return cmd.Args[0]
+	}
+	if len(cmd.SecretRefs) > 0 {
+		return cmd.SecretRefs[0].Item
+	}
+	return ""
+}
+
+// Returns the fields the command reads, from --fields or secret references.
+func (cmd *OpCommand) Fields() []string {
+	var fields []string
+	if value, ok := cmd.Flag("fields"); ok {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, field)
+			}
+		}
+	}
+	for _, ref := range cmd.SecretRefs {
+		if ref.Field != "" {
+			fields = append(fields, ref.Field)
+		}
+	}
+	return fields
+}
+
+// Returns labeled details of the command for prompts, with values quoted.
+func (cmd *OpCommand) Details() [][2]string {
+	var details [][2]string
+
+	if name := cmd.Name(); name != "" {
+		details = append(details, [2]string{"Command", name})
+	}
+	if vault := cmd.Vault(); vault != "" {
+		details = append(details, [2]string{"Vault", QuoteArg(vault)})
+	}
+	if item := cmd.Item(); item != "" {
+		details = append(details, [2]string{"Item", QuoteArg(item)})
+	}
+	if fields := cmd.Fields(); len(fields) > 0 {
+		details = append(details, [2]string{"Fields", FormatArgs(fields)})
+	}
+	for _, ref := range cmd.SecretRefs {
+		details = append(details, [2]string{"Secret", QuoteArg(ref.Raw)})
+	}
+	if len(cmd.Passthrough) > 0 {
+		details = append(details, [2]string{"Runs", FormatArgs(cmd.Passthrough)})
+	}
+	if len(cmd.UnknownFlags) > 0 {
+		unknown := make([]string, len(cmd.UnknownFlags))
+		for i, name := range cmd.UnknownFlags {
+			unknown[i] = "--" + name
+		}
+		details = append(details, [2]string{"Unknown flags", FormatArgs(unknown)})
+	}
+
+	return details
+}
+
+// Returns the canonical form of the command: subcommand path with aliases
+// resolved, positional args, then flags sorted by name as `--name=value` with
+// short aliases expanded, and finally `--` with the passthrough args. Equivalent commands
+// like `item get X --vault Y` and `item get --vault=Y X` share the form.
+//
+// Commands with unknown flags are returned as-is since their values can't be
+// told apart from positional args, so reordering could change the meaning.
+func CanonicalArgs(args []string) []string {
+	cmd := ParseOpCommand(args)
+	if len(cmd.UnknownFlags) > 0 {
+		return append([]string{}, args...)
+	}
+
+	canonical := make([]string, 0, len(args))
+	canonical = append(canonical, cmd.Path...)
+	canonical = append(canonical, cmd.Args...)
+
+	// Stable sort keeps the order of repeated flags, which op may rely on
+	flags := append(append([]OpFlag{}, cmd.GlobalFlags...), cmd.Flags...)
+	sort.SliceStable(flags, func(i, j int) bool {
+		return flags[i].Name < flags[j].Name
+	})
+	for _, flag := range flags {
+		if flag.HasValue {
+			canonical = append(canonical, "--"+flag.Name+"="+flag.Value)
+		} else {
+			canonical = append(canonical, "--"+flag.Name)
+		}
+	}
+
+	if cmd.Passthrough != nil {
+		canonical = append(canonical, "--")
+		canonical = append(canonical, cmd.Passthrough...)
+	}
+
+	return canonical
+}
@@ -0,0 +1,422 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pending one-time pairing code stored next to config.json.
+const pairingFileName = "pairing.json"
+
+const (
+	PairingCodeTTL         = 5 * time.Minute
+	pairingCodeMaxAttempts = 5
+	// Unambiguous characters to make the code easy to type
+	pairingCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	pairingCodeLength   = 8
+)
+
+// Maximum length of the client name chosen when pairing.
+const maxClientNameLength = 64
+
+// Maximum clock difference between the client and the server.
+const SignatureMaxSkew = 5 * time.Minute
+
+// Request signature headers.
+const (
+	ClientIDHeader  = "X-Op-Agent-Client-Id"
+	TimestampHeader = "X-Op-Agent-Timestamp"
+	NonceHeader     = "X-Op-Agent-Nonce"
+	SignatureHeader = "X-Op-Agent-Signature"
+)
+
+// Client paired with the server via `op-agent pair`.
+type PairedClient struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"` // Base64-encoded Ed25519 public key
+	CreatedAt string `json:"created_at"`
+}
+
+type pairingState struct {
+	CodeHash  string `json:"code_hash"`
+	ExpiresAt string `json:"expires_at"`
+	Attempts  int    `json:"attempts"`
+}
+
+// Pairing request sent by `op-agent-client pair`.
+type PairRequest struct {
+	Code      string `json:"code"`
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+}
+
+type PairResponse struct {
+	ID string `json:"id"`
+}
+
+// Client identity stored by `op-agent-client pair`.
+type ClientIdentity struct {
+	ID         string `json:"id"`
+	PrivateKey string `json:"private_key"` // Base64-encoded Ed25519 seed
+}
+
+func getPairingPath() (string, error) {
+	configDir, err := GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, pairingFileName), nil
+}
+
+// Generates a new one-time pairing code, replacing the pending one.
+func CreatePairingCode() (string, time.Time, error) {
+	pairingPath, err := getPairingPath()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var code strings.Builder
+	alphabetSize := big.NewInt(int64(len(pairingCodeAlphabet)))
+	for i := 0; i < pairingCodeLength; i++ {
+		if i == pairingCodeLength/2 {
+			code.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("failed to generate pairing code: %v", err)
+		}
+		code.WriteByte(pairingCodeAlphabet[n.Int64()])
+	}
+
+	expiresAt := time.Now().Add(PairingCodeTTL)
+	state := pairingState{
+		CodeHash:  hashPairingCode(code.String()),
+		ExpiresAt: expiresAt.Format(time.RFC3339),
+	}
+
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer unlock()
+
+	if err := writePairingState(pairingPath, &state); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return code.String(), expiresAt, nil
+}
+
+// Checks the code against the pending pairing code. A matching code can be
+// used only once, and the pending code is dropped after too many attempts.
+// The check holds the config lock, so concurrent requests can't both consume
+// the code or exceed the attempts.
+func ConsumePairingCode(code string) error {
+	pairingPath, err := getPairingPath()
+	if err != nil {
+		return err
+	}
+
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := os.ReadFile(pairingPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no pending pairing code")
+		}
+		return fmt.Errorf("failed to read pairing state: %v", err)
+	}
+
+	var state pairingState
+	if err := json.Unmarshal(data, &state); err != nil {
+		os.Remove(pairingPath)
+		return fmt.Errorf("failed to parse pairing state: %v", err)
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, state.ExpiresAt)
+	if err != nil || time.Now().After(expiresAt) {
+		os.Remove(pairingPath)
+		return fmt.Errorf("pairing code expired")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashPairingCode(code)), []byte(state.CodeHash)) != 1 {
+		state.Attempts++
+		if state.Attempts >= pairingCodeMaxAttempts {
+			os.Remove(pairingPath)
+		} else if err := writePairingState(pairingPath, &state); err != nil {
+			return err
+		}
+		return fmt.Errorf("invalid pairing code")
+	}
+
+	if err := os.Remove(pairingPath); err != nil {
+		return fmt.Errorf("failed to remove pairing state: %v", err)
+	}
+
+	return nil
+}
+
+func hashPairingCode(code string) string {
+	normalized := strings.ReplaceAll(strings.ToUpper(strings.TrimSpace(code)), "-", "")
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+func writePairingState(path string, state *pairingState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pairing state: %v", err)
+	}
+	if err := WriteFileAtomic(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write pairing state: %v", err)
+	}
+	return nil
+}
+
+// Validates the name the client chose when pairing. It's displayed in the
+// approval prompt, so names that could spoof it are refused.
+func ValidateClientName(name string) error {
+	if len(name) > maxClientNameLength {
+		return fmt.Errorf("the client name is too long: %d bytes, maximum is %d", len(name), maxClientNameLength)
+	}
+	if hasUnsafeRunes(name) {
+		return fmt.Errorf("the client name contains control or invisible characters")
+	}
+	return nil
+}
+
+// Generates a random client ID.
+func NewClientID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate client ID: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (c *Config) FindClient(id string) *PairedClient {
+	for i := range c.Clients {
+		if c.Clients[i].ID == id {
+			return &c.Clients[i]
+		}
+	}
+	return nil
+}
+
+func (c *Config) AddClient(client PairedClient) {
+	c.Clients = append(c.Clients, client)
+}
+
+func (c *Config) RemoveClient(id string) bool {
+	for i := range c.Clients {
+		if c.Clients[i].ID == id {
+			c.Clients = append(c.Clients[:i], c.Clients[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Client identity file path from OP_AGENT_CLIENT_KEY_FILE or the default one.
+func GetClientIdentityPath() (string, error) {
+	if path := os.Getenv(AgentClientKeyFileEnvName); path != "" {
+		return path, nil
+	}
+
+	configDir, err := getConfigDirPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "client.json"), nil
+}
+
+// Loads the client identity, returning nil if the client isn't paired.
+func LoadClientIdentity() (*ClientIdentity, error) {
+	path, err := GetClientIdentityPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read client identity: %v", err)
+	}
+
+	var identity ClientIdentity
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, fmt.Errorf("failed to parse client identity: %v", err)
+	}
+
+	return &identity, nil
+}
+
+func SaveClientIdentity(identity *ClientIdentity) error {
+	path, err := GetClientIdentityPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create client identity directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal client identity: %v", err)
+	}
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write client identity: %v", err)
+	}
+
+	return nil
+}
+
+// Generates a new client keypair, returning the base64-encoded seed and public key.
+func GenerateClientKey() (string, string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate client key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(privateKey.Seed()), base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+func signaturePayload(method, path, timestamp, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(strings.Join([]string{method, path, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n"))
+}
+
+// Signs the request with the client key, binding the method, path, body,
+// timestamp and a random nonce.
+func (identity *ClientIdentity) SignRequest(req *http.Request, body []byte) error {
+	seed, err := base64.StdEncoding.DecodeString(identity.PrivateKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("invalid client private key")
+	}
+	privateKey := ed25519.NewKeyFromSeed(seed)
+
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	signature := ed25519.Sign(privateKey, signaturePayload(req.Method, req.URL.Path, timestamp, nonce, body))
+
+	req.Header.Set(ClientIDHeader, identity.ID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(signature))
+
+	return nil
+}
+
+// Remembers seen nonces within the signature window to reject replays.
+type NonceCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func NewNonceCache() *NonceCache {
+	return &NonceCache{nonces: map[string]time.Time{}}
+}
+
+// Records the nonce, returning false if it was already seen.
+func (c *NonceCache) Add(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for seen, expiresAt := range c.nonces {
+		if now.After(expiresAt) {
+			delete(c.nonces, seen)
+		}
+	}
+
+	if _, ok := c.nonces[nonce]; ok {
+		return false
+	}
+	c.nonces[nonce] = now.Add(2 * SignatureMaxSkew)
+	return true
+}
+
+// Verifies the request signature of a paired client. The body is read and
+// restored so the handler can decode it.
+func VerifyRequestSignature(r *http.Request, client *PairedClient, nonces *NonceCache) (DenialReason, bool) {
+	publicKey, err := base64.StdEncoding.DecodeString(client.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return DenialReasonInvalidSignature, false
+	}
+
+	timestamp := r.Header.Get(TimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return DenialReasonStaleTimestamp, false
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > SignatureMaxSkew || skew < -SignatureMaxSkew {
+		return DenialReasonStaleTimestamp, false
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil {
+		return DenialReasonInvalidSignature, false
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return DenialReasonBodyTooLarge, false
+		}
+		return DenialReasonInvalidSignature, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	nonce := r.Header.Get(NonceHeader)
+	payload := signaturePayload(r.Method, r.URL.Path, timestamp, nonce, body)
+	if nonce == "" || !ed25519.Verify(publicKey, payload, signature) {
+		return DenialReasonInvalidSignature, false
+	}
+
+	// Check the nonce only after the signature, so forged requests can't fill the cache
+	if !nonces.Add(client.ID + ":" + nonce) {
+		return DenialReasonReplayedRequest, false
+	}
+
+	return "", true
+}
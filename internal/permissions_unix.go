@@ -0,0 +1,54 @@
+//go:build !windows
+
+package internal
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Refuses the file or directory if it's owned by another user or
+// accessible by the group or others, i.e., via a careless bind mount into a
+// container. Missing files are fine. System files, i.e., the system policy,
+// may be owned by root and readable by others, but not writable.
+func checkPermissions(path string, system bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		uid := int(stat.Uid)
+		if uid != os.Getuid() && !(system && uid == 0) {
+			return fmt.Errorf("refusing to load %s: it's owned by uid %d instead of %d", path, uid, os.Getuid())
+		}
+	}
+
+	expected := os.FileMode(0600)
+	if info.IsDir() {
+		expected = 0700
+	}
+	mode := info.Mode().Perm()
+	if mode&0022 != 0 {
+		return fmt.Errorf("refusing to load %s: it's writable by the group or others (mode %#o), run 'chmod %o %s'", path, mode, expected, path)
+	}
+	if !system && mode&0077 != 0 {
+		return fmt.Errorf("refusing to load %s: it's accessible by the group or others (mode %#o), run 'chmod %o %s'", path, mode, expected, path)
+	}
+
+	return nil
+}
+
+// Sets the umask so new files are accessible only by the current user,
+// returning the function that restores it. The umask is process-wide, so
+// it's meant for the startup, before other goroutines create files.
+func restrictUmask() func() {
+	previous := syscall.Umask(0077)
+	return func() {
+		syscall.Umask(previous)
+	}
+}
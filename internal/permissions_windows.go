@@ -0,0 +1,12 @@
+package internal
+
+// File permissions aren't checked on Windows, where the config is protected
+// by the ACLs inherited from the user profile.
+func checkPermissions(path string, system bool) error {
+	return nil
+}
+
+// The umask doesn't exist on Windows.
+func restrictUmask() func() {
+	return func() {}
+}
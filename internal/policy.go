@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+const policyFileName = "policy.json"
+
+// Read-only system policy managed by the organization. Its deny rules can't
+// be overridden by the user config, its approvals are available to every
+// user, and its limits cap the user limits.
+type Policy struct {
+	ApprovedCommands []CommandRule  `json:"approved,omitempty"`
+	DeniedCommands   []CommandRule  `json:"denied,omitempty"`
+	Limits           *RequestLimits `json:"limits,omitempty"`
+}
+
+// Returns the system policy path: /etc/op-agent/policy.json on macOS and
+// Linux, and %ProgramData%\op-agent\policy.json on Windows.
+func GetPolicyPath() string {
+	if runtime.GOOS == "windows" {
+		programData := os.Getenv("ProgramData")
+		if programData == "" {
+			programData = `C:\ProgramData`
+		}
+		return filepath.Join(programData, "op-agent", policyFileName)
+	}
+	return filepath.Join("/etc", "op-agent", policyFileName)
+}
+
+// Loads the system policy, returning nil if there's none. An invalid policy
+// is an error rather than ignored, so a broken file can't lift the
+// mandatory deny rules.
+func LoadPolicy() (*Policy, error) {
+	policyPath := GetPolicyPath()
+
+	// Only root or the user running op-agent may be able to change the policy
+	if err := checkPermissions(policyPath, true); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(policyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read policy file %s: %v", policyPath, err)
+	}
+
+	var policy Policy
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Catch typos like "deny" that would silently drop the rules
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %v", policyPath, err)
+	}
+
+	for _, rules := range [][]CommandRule{policy.ApprovedCommands, policy.DeniedCommands} {
+		for _, rule := range rules {
+			if rule.MaxUses > 0 || rule.Uses > 0 {
+				return nil, fmt.Errorf("invalid policy file %s: max_uses isn't supported in the system policy", policyPath)
+			}
+			if rule.Pattern {
+				if err := ValidatePattern(rule.Args); err != nil {
+					return nil, fmt.Errorf("invalid policy file %s: %v", policyPath, err)
+				}
+			}
+		}
+	}
+
+	policy.ApprovedCommands, _ = normalizeRules(policy.ApprovedCommands)
+	policy.DeniedCommands, _ = normalizeRules(policy.DeniedCommands)
+
+	return &policy, nil
+}
+
+// Returns the system policy the config was loaded with, or nil.
+func (c *Config) Policy() *Policy {
+	return c.policy
+}
+
+// Checks if the command matches a deny rule of the system policy.
+func (c *Config) IsCommandDeniedByPolicy(args []string, requester Requester) bool {
+	return c.policy != nil && findDenyRule(c.policy.DeniedCommands, args, requester, time.Now()) != nil
+}
+
+// Checks if the command is approved by the system policy.
+func (c *Config) IsCommandApprovedByPolicy(args []string, requester Requester) bool {
+	return c.policy != nil && findRule(c.policy.ApprovedCommands, args, requester, time.Now()) != nil
+}
+
+// Caps the limits with the policy limits.
+func (p *Policy) capLimits(limits RequestLimits) RequestLimits {
+	if p == nil || p.Limits == nil {
+		return limits
+	}
+	if p.Limits.MaxBodyBytes > 0 && limits.MaxBodyBytes > p.Limits.MaxBodyBytes {
+		limits.MaxBodyBytes = p.Limits.MaxBodyBytes
+	}
+	if p.Limits.MaxArgs > 0 && limits.MaxArgs > p.Limits.MaxArgs {
+		limits.MaxArgs = p.Limits.MaxArgs
+	}
+	if p.Limits.MaxArgLength > 0 && limits.MaxArgLength > p.Limits.MaxArgLength {
+		limits.MaxArgLength = p.Limits.MaxArgLength
+	}
+	return limits
+}
+
+// Rule with the layer it comes from.
+type LayeredRule struct {
+	Layer string      `json:"layer"` // system or user
+	Rule  CommandRule `json:"rule"`
+}
+
+// Merged view of the system policy and the user config.
+type EffectiveConfig struct {
+	PolicyPath       string         `json:"policy_path,omitempty"`
+	ApprovedCommands []LayeredRule  `json:"approved"`
+	DeniedCommands   []LayeredRule  `json:"denied"`
+	Limits           RequestLimits  `json:"limits"`
+	Clients          []PairedClient `json:"clients,omitempty"`
+}
+
+const (
+	LayerSystem = "system"
+	LayerUser   = "user"
+)
+
+// Returns the config merged with the system policy, in the order rules are
+// evaluated.
+func (c *Config) Effective() EffectiveConfig {
+	effective := EffectiveConfig{
+		ApprovedCommands: []LayeredRule{},
+		DeniedCommands:   []LayeredRule{},
+		Limits:           c.GetLimits(),
+		Clients:          c.Clients,
+	}
+
+	if c.policy != nil {
+		effective.PolicyPath = GetPolicyPath()
+		effective.DeniedCommands = appendLayer(effective.DeniedCommands, LayerSystem, c.policy.DeniedCommands)
+	}
+	effective.DeniedCommands = appendLayer(effective.DeniedCommands, LayerUser, c.DeniedCommands)
+
+	effective.ApprovedCommands = appendLayer(effective.ApprovedCommands, LayerUser, c.ApprovedCommands)
+	if c.policy != nil {
+		effective.ApprovedCommands = appendLayer(effective.ApprovedCommands, LayerSystem, c.policy.ApprovedCommands)
+	}
+
+	return effective
+}
+
+func appendLayer(layered []LayeredRule, layer string, rules []CommandRule) []LayeredRule {
+	for _, rule := range rules {
+		layered = append(layered, LayeredRule{Layer: layer, Rule: rule})
+	}
+	return layered
+}
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"bufio"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Project context sent by op-agent-client.
+const (
+	WorkspaceHeader    = "X-Op-Agent-Workspace"
+	GitRemoteHeader    = "X-Op-Agent-Git-Remote"
+	DevcontainerHeader = "X-Op-Agent-Devcontainer"
+)
+
+const maxProjectValueLength = 256
+
+// Project the command is requested from, detected by the client.
+type ProjectContext struct {
+	Workspace    string `json:"workspace,omitempty"`  // Workspace folder name
+	GitRemote    string `json:"git_remote,omitempty"` // Normalized origin URL, i.e., `github.com/acme/api`
+	Devcontainer string `json:"devcontainer,omitempty"`
+}
+
+// Caller and project of the request that scoped rules are matched against.
+type Requester struct {
+	Caller  Caller
+	Project ProjectContext
+}
+
+var devcontainerNameRegexp = regexp.MustCompile(`"name"\s*:\s*"([^"]*)"`)
+
+// Returns the key approvals are scoped by: the git remote, the devcontainer
+// name, or the workspace folder name, whichever is known first.
+func (p ProjectContext) Key() string {
+	switch {
+	case p.GitRemote != "":
+		return p.GitRemote
+	case p.Devcontainer != "":
+		return p.Devcontainer
+	default:
+		return p.Workspace
+	}
+}
+
+func (p ProjectContext) IsEmpty() bool {
+	return p.Workspace == "" && p.GitRemote == "" && p.Devcontainer == ""
+}
+
+// Sets the project headers on the request.
+func (p ProjectContext) SetHeaders(req *http.Request) {
+	for header, value := range map[string]string{
+		WorkspaceHeader:    p.Workspace,
+		GitRemoteHeader:    p.GitRemote,
+		DevcontainerHeader: p.Devcontainer,
+	} {
+		if value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+}
+
+// Reads the project headers, ignoring values that are too long or contain
+// characters that could spoof the prompt.
+func ProjectFromRequest(r *http.Request) ProjectContext {
+	value := func(header string) string {
+		value := strings.TrimSpace(r.Header.Get(header))
+		if len(value) > maxProjectValueLength || hasUnsafeRunes(value) {
+			return ""
+		}
+		return value
+	}
+
+	return ProjectContext{
+		Workspace:    value(WorkspaceHeader),
+		GitRemote:    value(GitRemoteHeader),
+		Devcontainer: value(DevcontainerHeader),
+	}
+}
+
+// Detects the project of the working directory: the repository root or the
+// directory itself, its origin remote and the devcontainer name.
+func DetectProject() ProjectContext {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ProjectContext{}
+	}
+
+	root, gitDir := findGitRoot(dir)
+	if root == "" {
+		root = dir
+	}
+
+	project := ProjectContext{Workspace: filepath.Base(root)}
+	if gitDir != "" {
+		project.GitRemote = NormalizeGitRemote(readOriginURL(gitDir))
+	}
+	project.Devcontainer = readDevcontainerName(root)
+
+	return project
+}
+
+// Walks up from the directory to the repository root, returning the root
+// and the git directory.
+func findGitRoot(dir string) (string, string) {
+	for {
+		gitPath := filepath.Join(dir, ".git")
+		if info, err := os.Stat(gitPath); err == nil {
+			if info.IsDir() {
+				return dir, gitPath
+			}
+			// Worktrees and submodules point to the git directory
+			if data, err := os.ReadFile(gitPath); err == nil {
+				if gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: "); ok {
+					if !filepath.IsAbs(gitDir) {
+						gitDir = filepath.Join(dir, gitDir)
+					}
+					return dir, gitDir
+				}
+			}
+			return dir, ""
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ""
+		}
+		dir = parent
+	}
+}
+
+// Reads the origin URL from the git config, following worktrees to the
+// common git directory.
+func readOriginURL(gitDir string) string {
+	if data, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		commonDir := strings.TrimSpace(string(data))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(gitDir, commonDir)
+		}
+		gitDir = commonDir
+	}
+
+	file, err := os.Open(filepath.Join(gitDir, "config"))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	inOrigin := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inOrigin = line == `[remote "origin"]`
+			continue
+		}
+		if !inOrigin {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && strings.TrimSpace(key) == "url" {
+			return strings.TrimSpace(value)
+		}
+	}
+
+	return ""
+}
+
+// Normalizes the git remote URL to `host/path`, dropping the scheme,
+// credentials and the .git suffix, so HTTPS and SSH remotes of the same
+// repository match, i.e., `git@github.com:acme/api.git` becomes
+// `github.com/acme/api`.
+func NormalizeGitRemote(remote string) string {
+	remote = strings.TrimSpace(remote)
+	if remote == "" {
+		return ""
+	}
+
+	var host, path string
+	if parsed, err := url.Parse(remote); err == nil && parsed.Host != "" {
+		host, path = parsed.Hostname(), parsed.Path
+	} else if userHost, scpPath, ok := strings.Cut(remote, ":"); ok && !strings.Contains(userHost, "/") {
+		// scp-like syntax, i.e., `git@github.com:acme/api.git`
+		_, host, _ = strings.Cut(userHost, "@")
+		if host == "" {
+			host = userHost
+		}
+		path = scpPath
+	} else {
+		// Local path remotes
+		return filepath.ToSlash(filepath.Clean(remote))
+	}
+
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	return strings.ToLower(host) + "/" + path
+}
+
+// Reads the name from devcontainer.json in the project root.
+func readDevcontainerName(root string) string {
+	for _, path := range []string{
+		filepath.Join(root, ".devcontainer", "devcontainer.json"),
+		filepath.Join(root, ".devcontainer.json"),
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		// devcontainer.json allows comments, so the name is matched rather
+		// than parsed
+		if match := devcontainerNameRegexp.FindSubmatch(data); match != nil {
+			return string(match[1])
+		}
+		return ""
+	}
+	return ""
+}
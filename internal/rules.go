@@ -0,0 +1,391 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pattern marker matching any remaining arguments.
+const RestMarker = "..."
+
+// Command rule in the config. Exact rules are stored as plain argument arrays
+// to keep the original format, pattern rules and rules with metadata as
+// objects:
+//
+//	["item", "get", "X", "--vault=Y"]
+//	{"args": ["read", "op://dev/*/password"], "pattern": true}
+//	{"args": ["whoami"], "expires_at": "2025-09-01T12:00:00Z", "max_uses": 5}
+//	{"args": ["whoami"], "client": "container:4f2a…"}
+//	{"args": ["read", "op://acme-api/db/password"], "project": "github.com/acme/api"}
+//
+// In pattern rules, each argument can be a glob (`*`, `?`, `[...]`), a regex
+// wrapped in slashes (`/^dev-.*$/`), or `...` as the last argument to match
+// any remaining arguments. Flag values are matched separately from the name,
+// i.e., `--vault=/^dev-/`.
+type CommandRule struct {
+	Args      []string `json:"args"`
+	Pattern   bool     `json:"pattern,omitempty"`
+	ExpiresAt string   `json:"expires_at,omitempty"` // RFC 3339
+	MaxUses   int      `json:"max_uses,omitempty"`
+	Uses      int      `json:"uses,omitempty"`
+	Client    Caller   `json:"client,omitempty"`  // Applies to every caller if empty
+	Project   string   `json:"project,omitempty"` // Project key, applies to every project if empty
+	// Provenance: when and how the rule was added and which caller requested it
+	CreatedAt string         `json:"created_at,omitempty"` // RFC 3339
+	Source    ApprovalSource `json:"source,omitempty"`
+	Origin    Caller         `json:"origin,omitempty"`
+	// Usage, updated when the rule approves a request
+	LastUsedAt string `json:"last_used_at,omitempty"` // RFC 3339
+}
+
+type commandRuleObject CommandRule
+
+func (r CommandRule) MarshalJSON() ([]byte, error) {
+	if !r.Pattern && !r.hasMetadata() {
+		return json.Marshal(r.Args)
+	}
+	return json.Marshal(commandRuleObject(r))
+}
+
+func (r *CommandRule) UnmarshalJSON(data []byte) error {
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		*r = CommandRule{}
+		return json.Unmarshal(data, &r.Args)
+	}
+
+	var obj commandRuleObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	*r = CommandRule(obj)
+	return nil
+}
+
+func NewExactRule(args []string) CommandRule {
+	return CommandRule{Args: CanonicalArgs(args)}
+}
+
+// Creates a pattern rule, validating the regexes and globs.
+func NewPatternRule(args []string) (CommandRule, error) {
+	if err := ValidatePattern(args); err != nil {
+		return CommandRule{}, err
+	}
+
+	base, rest := splitRestMarker(args)
+	canonical := CanonicalArgs(base)
+	if rest {
+		canonical = append(canonical, RestMarker)
+	}
+
+	return CommandRule{Args: canonical, Pattern: true}, nil
+}
+
+// Checks that every argument of the pattern is a valid glob or regex.
+func ValidatePattern(args []string) error {
+	for i, arg := range args {
+		if arg == RestMarker {
+			if i != len(args)-1 {
+				return fmt.Errorf("%s must be the last argument", RestMarker)
+			}
+			continue
+		}
+
+		value := arg
+		if _, flagValue, ok := splitFlagValue(arg); ok {
+			value = flagValue
+		}
+
+		if expr, ok := regexBody(value); ok {
+			if _, err := regexp.Compile(expr); err != nil {
+				return fmt.Errorf("argument %d: invalid regex: %v", i+1, err)
+			}
+		} else if _, err := path.Match(value, ""); err != nil {
+			return fmt.Errorf("argument %d: invalid glob %s", i+1, QuoteArg(value))
+		}
+	}
+	return nil
+}
+
+func (r *CommandRule) Matches(args []string) bool {
+	canonical := CanonicalArgs(args)
+	if !r.Pattern {
+		return commandsEqual(CanonicalArgs(r.Args), canonical)
+	}
+	return matchPattern(expandPattern(r.Args), canonical)
+}
+
+// Checks if the deny rule applies to the command. Commands with unknown
+// flags can't be canonicalized, so they can't be matched reliably, i.e.,
+// `--share-link item delete X`. Such commands fail closed: the rule applies
+// if they contain its subcommand path, whatever the flags mean.
+func (r *CommandRule) Denies(args []string) bool {
+	if r.Matches(args) {
+		return true
+	}
+	if len(ParseOpCommand(args).UnknownFlags) == 0 {
+		return false
+	}
+	base, _ := splitRestMarker(r.Args)
+	return containsPath(args, ParseOpCommand(base).Path)
+}
+
+// Checks if the non-flag arguments contain the subcommand path in order,
+// with aliases resolved. Flag values can't be told apart, so they count too.
+func containsPath(args []string, path []string) bool {
+	for _, arg := range args {
+		if len(path) == 0 {
+			break
+		}
+		if isFlag(arg) {
+			continue
+		}
+		if name, ok := opSubcommandAliases[arg]; ok {
+			arg = name
+		}
+		if arg == path[0] {
+			path = path[1:]
+		}
+	}
+	return len(path) == 0
+}
+
+// Checks if the rules have the same arguments, ignoring the metadata.
+func (r *CommandRule) Equal(other CommandRule) bool {
+	return r.Pattern == other.Pattern && commandsEqual(r.Args, other.Args)
+}
+
+// Checks if the rules have the same arguments, scope and metadata.
+func (r *CommandRule) Identical(other CommandRule) bool {
+	return r.sameScope(other) && r.ExpiresAt == other.ExpiresAt && r.MaxUses == other.MaxUses && r.Uses == other.Uses
+}
+
+// Checks if the rules have the same arguments and scope, so one replaces the
+// other when added.
+func (r *CommandRule) sameScope(other CommandRule) bool {
+	return r.Equal(other) && r.Client == other.Client && r.Project == other.Project
+}
+
+func (r *CommandRule) hasMetadata() bool {
+	return r.ExpiresAt != "" || r.MaxUses > 0 || r.Uses > 0 || r.Client != "" || r.Project != "" ||
+		r.CreatedAt != "" || r.Source != "" || r.Origin != "" || r.LastUsedAt != ""
+}
+
+// Checks if the rule applies to the caller and project of the request.
+func (r *CommandRule) AppliesTo(requester Requester) bool {
+	return (r.Client == "" || r.Client == requester.Caller) &&
+		(r.Project == "" || r.Project == requester.Project.Key())
+}
+
+// Checks if the rule hasn't expired or run out of uses. Rules with an
+// invalid expiration time are treated as expired.
+func (r *CommandRule) Active(now time.Time) bool {
+	if r.MaxUses > 0 && r.Uses >= r.MaxUses {
+		return false
+	}
+	if r.ExpiresAt == "" {
+		return true
+	}
+	expiresAt, err := time.Parse(time.RFC3339, r.ExpiresAt)
+	return err == nil && now.Before(expiresAt)
+}
+
+// Returns the expiration time and true if the rule expires.
+func (r *CommandRule) Expiration() (time.Time, bool) {
+	if r.ExpiresAt == "" {
+		return time.Time{}, false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, r.ExpiresAt)
+	return expiresAt, err == nil
+}
+
+func (r *CommandRule) SetExpiration(expiresAt time.Time) {
+	r.ExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+}
+
+// Records when and how the rule was added, and the caller that requested it.
+func (r *CommandRule) SetProvenance(source ApprovalSource, origin Caller, now time.Time) {
+	r.CreatedAt = now.UTC().Format(time.RFC3339)
+	r.Source = source
+	r.Origin = origin
+}
+
+// Records that the rule approved a request, counting the use.
+func (r *CommandRule) MarkUsed(now time.Time) {
+	r.LastUsedAt = now.UTC().Format(time.RFC3339)
+	r.Uses++
+}
+
+// Returns when the rule was added and true if it's known.
+func (r *CommandRule) Created() (time.Time, bool) {
+	if r.CreatedAt == "" {
+		return time.Time{}, false
+	}
+	createdAt, err := time.Parse(time.RFC3339, r.CreatedAt)
+	return createdAt, err == nil
+}
+
+// Returns when the rule was last used and true if it's known.
+func (r *CommandRule) LastUsed() (time.Time, bool) {
+	if r.LastUsedAt == "" {
+		return time.Time{}, false
+	}
+	lastUsedAt, err := time.Parse(time.RFC3339, r.LastUsedAt)
+	return lastUsedAt, err == nil
+}
+
+// Returns the rule for display, marking pattern and scoped rules.
+func (r *CommandRule) String() string {
+	var marks []string
+	if r.Pattern {
+		marks = append(marks, "pattern")
+	}
+	if r.Client != "" {
+		marks = append(marks, "client "+r.Client.Short())
+	}
+	if r.Project != "" {
+		marks = append(marks, "project "+QuoteArg(r.Project))
+	}
+
+	if len(marks) == 0 {
+		return "op " + FormatArgs(r.Args)
+	}
+	return "op " + FormatArgs(r.Args) + " (" + strings.Join(marks, ", ") + ")"
+}
+
+func splitRestMarker(args []string) ([]string, bool) {
+	if len(args) > 0 && args[len(args)-1] == RestMarker {
+		return args[:len(args)-1], true
+	}
+	return args, false
+}
+
+// Expands the pattern in the canonical form. Since flags are sorted, extra
+// arguments allowed by the rest marker can appear after the positional args
+// and between any flags, so the marker is placed in each of these gaps.
+func expandPattern(args []string) []string {
+	base, rest := splitRestMarker(args)
+	canonical := CanonicalArgs(base)
+	if !rest {
+		return canonical
+	}
+
+	cmd := ParseOpCommand(base)
+	if len(cmd.UnknownFlags) > 0 {
+		return append(canonical, RestMarker)
+	}
+
+	positional := len(cmd.Path) + len(cmd.Args)
+	expanded := append(append([]string{}, canonical[:positional]...), RestMarker)
+	for _, arg := range canonical[positional:] {
+		expanded = append(expanded, arg, RestMarker)
+	}
+	return expanded
+}
+
+// Matches the arguments against the expanded pattern, where the rest marker
+// matches zero or more arguments.
+func matchPattern(pattern []string, args []string) bool {
+	if len(pattern) == 0 {
+		return len(args) == 0
+	}
+
+	if pattern[0] == RestMarker {
+		for i := 0; i <= len(args); i++ {
+			if matchPattern(pattern[1:], args[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(args) == 0 || !matchArg(pattern[0], args[0]) {
+		return false
+	}
+	return matchPattern(pattern[1:], args[1:])
+}
+
+func matchArg(pattern string, arg string) bool {
+	if patternName, patternValue, ok := splitFlagValue(pattern); ok {
+		name, value, ok := splitFlagValue(arg)
+		return ok && name == patternName && matchValue(patternValue, value)
+	}
+	// Positional patterns don't match flags, so `item get *` doesn't approve
+	// `item get --vault prod`
+	if !strings.HasPrefix(pattern, "-") && isFlag(arg) {
+		return false
+	}
+	return matchValue(pattern, arg)
+}
+
+func isFlag(arg string) bool {
+	return len(arg) > 1 && strings.HasPrefix(arg, "-")
+}
+
+func matchValue(pattern string, value string) bool {
+	if expr, ok := regexBody(pattern); ok {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		return err == nil && re.MatchString(value)
+	}
+
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// Splits `--name=value` into the name and value.
+func splitFlagValue(arg string) (string, string, bool) {
+	if !strings.HasPrefix(arg, "--") {
+		return "", "", false
+	}
+	return strings.Cut(arg, "=")
+}
+
+// Parses the duration like time.ParseDuration, additionally accepting days,
+// i.e., `7d`.
+func ParseDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %s", QuoteArg(value))
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid duration %s", QuoteArg(value))
+	}
+	return duration, nil
+}
+
+// In-memory rules that last until the server stops, i.e., approvals for
+// the session.
+type SessionRules struct {
+	mu    sync.Mutex
+	rules []CommandRule
+}
+
+func (s *SessionRules) Add(rule CommandRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules, _ = addRule(s.rules, rule)
+}
+
+func (s *SessionRules) Matches(args []string, requester Requester) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return findRule(s.rules, args, requester, time.Now()) != nil
+}
+
+// Returns the expression of a `/regex/` argument.
+func regexBody(value string) (string, bool) {
+	if len(value) >= 2 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/") {
+		return value[1 : len(value)-1], true
+	}
+	return "", false
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Listens on a Unix domain socket accessible only by the current user. A stale
+// socket left by a crashed agent is removed, but a live one is never replaced.
+func ListenUnixSocket(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another process is already listening on %s", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to check socket path: %v", err)
+	}
+
+	// Create the socket without access for others right away, instead of
+	// leaving a window before the chmod
+	restore := restrictUmask()
+	listener, err := net.Listen("unix", path)
+	restore()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %v", err)
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the server checks the config and the system policy for changes.
+const ConfigPollInterval = 2 * time.Second
+
+// Parsed config held in memory by the server. It's reloaded when the config
+// or the system policy file changes, keeping the last good config if the
+// reload fails.
+type ConfigStore struct {
+	mutex  sync.RWMutex
+	config *Config
+	stamps []fileStamp // Of the files the config was loaded from
+}
+
+// Modification time and size used to detect file changes without reading
+// the file.
+type fileStamp struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+}
+
+// Loads the config into a new store.
+func NewConfigStore() (*ConfigStore, error) {
+	store := &ConfigStore{}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Returns the last loaded config. It's shared between requests, so it must
+// not be modified; use Update instead.
+func (s *ConfigStore) Config() *Config {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.config
+}
+
+// Loads the config from disk. On error, the last good config is kept and
+// the files aren't reloaded again until they change.
+func (s *ConfigStore) Reload() error {
+	// Stamp before loading, so changes made while loading trigger a reload
+	stamps, err := configStamps()
+	if err != nil {
+		return err
+	}
+
+	config, err := LoadConfig()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stamps = stamps
+	if err != nil {
+		return err
+	}
+	s.config = config
+	return nil
+}
+
+// Checks if the config or the system policy changed since the last load.
+func (s *ConfigStore) Changed() bool {
+	stamps, err := configStamps()
+	if err != nil {
+		return false
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for i := range stamps {
+		if i >= len(s.stamps) || stamps[i] != s.stamps[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// Updates the config on disk with UpdateConfig and reloads it, so the change
+// applies to the next request without waiting for the poll.
+func (s *ConfigStore) Update(update func(config *Config) error) error {
+	if err := UpdateConfig(update); err != nil {
+		return err
+	}
+	if err := s.Reload(); err != nil {
+		return fmt.Errorf("failed to reload config: %v", err)
+	}
+	return nil
+}
+
+func configStamps() ([]fileStamp, error) {
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return nil, err
+	}
+
+	var stamps []fileStamp
+	for _, path := range []string{configPath, GetPolicyPath()} {
+		stamp, err := statFile(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, stamp)
+	}
+	return stamps, nil
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fileStamp{}, nil
+	}
+	if err != nil {
+		return fileStamp{}, fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	return fileStamp{exists: true, modTime: info.ModTime(), size: info.Size()}, nil
+}
@@ -0,0 +1,287 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Local CA and server certificate files stored next to config.json.
+const (
+	CACertFileName     = "ca.pem"
+	caKeyFileName      = "ca-key.pem"
+	serverCertFileName = "server.pem"
+	serverKeyFileName  = "server-key.pem"
+)
+
+const (
+	caValidity          = 10 * 365 * 24 * time.Hour
+	serverCertValidity  = 397 * 24 * time.Hour
+	serverCertRenewLeft = 30 * 24 * time.Hour
+)
+
+// Hosts the clients use to reach the agent by default.
+var defaultServerHosts = []string{"localhost", "host.docker.internal", "host.containers.internal", "127.0.0.1", "::1"}
+
+func DefaultServerHosts() []string {
+	return append([]string{}, defaultServerHosts...)
+}
+
+// Loads the local CA and server certificate, generating them on the first
+// start. The server certificate is reissued when it's about to expire or
+// doesn't cover the hosts.
+func LoadOrCreateServerTLS(hosts []string) (*tls.Config, *x509.Certificate, error) {
+	configDir, err := GetConfigDir()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caCert, caKey, err := loadOrCreateCA(configDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hosts = append(DefaultServerHosts(), hosts...)
+
+	certPath := filepath.Join(configDir, serverCertFileName)
+	keyPath := filepath.Join(configDir, serverKeyFileName)
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil || !serverCertValid(cert, caCert, hosts) {
+		if err := createServerCert(certPath, keyPath, caCert, caKey, hosts); err != nil {
+			return nil, nil, err
+		}
+		if cert, err = tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+			return nil, nil, fmt.Errorf("failed to load server certificate: %v", err)
+		}
+	}
+
+	// Send the CA along so clients can pin it by fingerprint
+	cert.Certificate = append(cert.Certificate, caCert.Raw)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, caCert, nil
+}
+
+func loadOrCreateCA(configDir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath := filepath.Join(configDir, CACertFileName)
+	keyPath := filepath.Join(configDir, caKeyFileName)
+
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		caCert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse CA certificate: %v", err)
+		}
+		caKey, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("unexpected CA key type")
+		}
+		return caCert, caKey, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("failed to load CA: %v", err)
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate CA key: %v", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "op-agent local CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %v", err)
+	}
+
+	if err := writeCertAndKey(certPath, keyPath, der, caKey); err != nil {
+		return nil, nil, err
+	}
+
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA certificate: %v", err)
+	}
+
+	return caCert, caKey, nil
+}
+
+func createServerCert(certPath, keyPath string, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate server key: %v", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "op-agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(serverCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create server certificate: %v", err)
+	}
+
+	return writeCertAndKey(certPath, keyPath, der, key)
+}
+
+func serverCertValid(cert tls.Certificate, caCert *x509.Certificate, hosts []string) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+
+	if time.Until(leaf.NotAfter) < serverCertRenewLeft {
+		return false
+	}
+
+	if leaf.CheckSignatureFrom(caCert) != nil {
+		return false
+	}
+
+	for _, host := range hosts {
+		if leaf.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func writeCertAndKey(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %v", err)
+	}
+
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(keyPath, keyPem, 0600); err != nil {
+		return fmt.Errorf("failed to write key: %v", err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certPath, certPem, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %v", err)
+	}
+
+	return nil
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+	return serial, nil
+}
+
+// Returns the SHA-256 fingerprint of the certificate as lowercase hex.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(fingerprint)), "sha256:")
+	return strings.ReplaceAll(fingerprint, ":", "")
+}
+
+// Returns the client TLS config when the CA is pinned via OP_AGENT_CA_FILE
+// or OP_AGENT_CA_FINGERPRINT, or nil when the agent is reached over HTTP.
+func GetClientTLSConfig() (*tls.Config, error) {
+	if caPath := os.Getenv(AgentCAFileEnvName); caPath != "" {
+		data, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", AgentCAFileEnvName, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caPath)
+		}
+
+		return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
+	}
+
+	if fingerprint := os.Getenv(AgentCAFingerprintEnvName); fingerprint != "" {
+		return pinnedTLSConfig(normalizeFingerprint(fingerprint)), nil
+	}
+
+	return nil, nil
+}
+
+// Accepts only chains issued by the CA with the given fingerprint. The default
+// verification is replaced as the CA isn't known upfront.
+func pinnedTLSConfig(fingerprint string) *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: true}
+
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		var ca *x509.Certificate
+		for _, cert := range state.PeerCertificates {
+			if CertFingerprint(cert) == fingerprint {
+				ca = cert
+				break
+			}
+		}
+		if ca == nil || len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("server certificate isn't issued by the pinned CA")
+		}
+
+		pool := x509.NewCertPool()
+		pool.AddCert(ca)
+
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:   pool,
+			DNSName: state.ServerName,
+		})
+		return err
+	}
+
+	return config
+}
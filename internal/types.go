@@ -10,3 +10,26 @@ type HandshakeResponse struct {
 	Version string `json:"version"`
 	Whoami  string `json:"whoami"`
 }
+
+// Error code returned in ErrorResponse.
+type ErrorCode string
+
+const (
+	ErrorCodeMethodNotAllowed ErrorCode = "method-not-allowed"
+	ErrorCodeInvalidJSON      ErrorCode = "invalid-json"
+	ErrorCodeInvalidRequest   ErrorCode = "invalid-request"
+	ErrorCodeBodyTooLarge     ErrorCode = "body-too-large"
+	ErrorCodeTooManyArgs      ErrorCode = "too-many-args"
+	ErrorCodeArgTooLong       ErrorCode = "arg-too-long"
+	ErrorCodeNulByte          ErrorCode = "nul-byte"
+	ErrorCodeForbidden        ErrorCode = "forbidden"
+	ErrorCodeUnauthorized     ErrorCode = "unauthorized"
+	ErrorCodeInternal         ErrorCode = "internal"
+)
+
+// Error returned by the agent with a non-200 status.
+type ErrorResponse struct {
+	Error  string       `json:"error"`
+	Code   ErrorCode    `json:"code"`
+	Reason DenialReason `json:"reason,omitempty"` // Of rejected requests
+}
@@ -0,0 +1,301 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+// Config problem with its location in the file.
+type ConfigIssue struct {
+	Line    int // 1-based, 0 if unknown
+	Column  int // 1-based, in runes
+	Message string
+}
+
+func (i ConfigIssue) String() string {
+	if i.Line == 0 {
+		return i.Message
+	}
+	return fmt.Sprintf("%d:%d: %s", i.Line, i.Column, i.Message)
+}
+
+// Config with the rules and clients kept raw, to validate each with its
+// location. Keep in sync with Config.
+type rawConfig struct {
+	Version          int               `json:"version"`
+	ApprovedCommands []json.RawMessage `json:"approved"`
+	DeniedCommands   []json.RawMessage `json:"denied"`
+	Clients          []json.RawMessage `json:"clients"`
+	Limits           *RequestLimits    `json:"limits"`
+	HMAC             string            `json:"hmac"`
+}
+
+var unknownFieldRegexp = regexp.MustCompile(`^json: unknown field "(.*)"$`)
+
+// Validates the config data, returning the problems found. Configs stored by
+// older versions are only checked to migrate, as the locations in the
+// original file wouldn't match the migrated rules.
+func ValidateConfig(data []byte) []ConfigIssue {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return []ConfigIssue{jsonIssue(data, 0, err)}
+	}
+
+	var raw rawConfig
+	if err := decodeStrict(data, &raw); err != nil {
+		return []ConfigIssue{jsonIssue(data, 0, err)}
+	}
+
+	// The rules are located by the first occurrence of the key while the
+	// decoding keeps the last one, so duplicates would check the wrong list
+	if issues := duplicateKeyIssues(data); len(issues) > 0 {
+		return issues
+	}
+
+	if raw.Version != ConfigVersion {
+		if _, _, err := MigrateConfig(data); err != nil {
+			return []ConfigIssue{{Message: err.Error()}}
+		}
+	}
+	if raw.Version < ConfigVersion {
+		return nil
+	}
+
+	var issues []ConfigIssue
+	for _, list := range []RuleList{RuleListApproved, RuleListDenied} {
+		offsets, err := arrayElementOffsets(data, string(list))
+		if err != nil {
+			return append(issues, jsonIssue(data, 0, err))
+		}
+		for i, offset := range offsets {
+			if err := validateRuleData(data[offset:]); err != nil {
+				issues = append(issues, elementIssue(data, offset, fmt.Sprintf("%s rule #%d", list, i+1), err))
+			}
+		}
+	}
+
+	offsets, err := arrayElementOffsets(data, "clients")
+	if err != nil {
+		return append(issues, jsonIssue(data, 0, err))
+	}
+	for i, offset := range offsets {
+		if err := validateClientData(data[offset:]); err != nil {
+			issues = append(issues, elementIssue(data, offset, fmt.Sprintf("client #%d", i+1), err))
+		}
+	}
+
+	if limits := raw.Limits; limits != nil && (limits.MaxBodyBytes < 0 || limits.MaxArgs < 0 || limits.MaxArgLength < 0) {
+		issues = append(issues, locatedIssue(data, keyOffset(data, 0, "limits"), fmt.Errorf("limits can't be negative")))
+	}
+
+	return issues
+}
+
+// Decodes the first value of the data, rejecting unknown fields.
+func decodeStrict(data []byte, value any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(value)
+}
+
+// Decodes and validates the rule at the start of the data.
+func validateRuleData(data []byte) error {
+	var value json.RawMessage
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&value); err != nil {
+		return err
+	}
+
+	var rule CommandRule
+	switch value[0] {
+	case '[':
+		if err := json.Unmarshal(value, &rule.Args); err != nil {
+			return err
+		}
+	case '{':
+		var obj commandRuleObject
+		if err := decodeStrict(value, &obj); err != nil {
+			return err
+		}
+		rule = CommandRule(obj)
+	default:
+		return fmt.Errorf("expected an argument array or a rule object")
+	}
+
+	return ValidateRule(rule)
+}
+
+// Decodes and validates the client at the start of the data.
+func validateClientData(data []byte) error {
+	var client PairedClient
+	if err := decodeStrict(data, &client); err != nil {
+		return err
+	}
+	if client.ID == "" {
+		return fmt.Errorf("the id is empty")
+	}
+	if err := ValidateClientName(client.Name); err != nil {
+		return err
+	}
+	if publicKey, err := base64.StdEncoding.DecodeString(client.PublicKey); err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public_key, expected a base64-encoded Ed25519 key")
+	}
+	return nil
+}
+
+// Converts a JSON decoding error to an issue, locating it using the offset of
+// syntax and type errors, or the field name of unknown field errors.
+func jsonIssue(data []byte, base int64, err error) ConfigIssue {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return locatedIssue(data, base+syntaxErr.Offset, err)
+	case errors.As(err, &typeErr):
+		return locatedIssue(data, base+typeErr.Offset, fmt.Errorf("%s must be %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value))
+	}
+
+	if match := unknownFieldRegexp.FindStringSubmatch(err.Error()); match != nil {
+		if offset := keyOffset(data, base, match[1]); offset >= 0 {
+			return locatedIssue(data, offset, fmt.Errorf("unknown field %s", QuoteArg(match[1])))
+		}
+	}
+
+	return ConfigIssue{Message: err.Error()}
+}
+
+// Converts an error of the array element at the offset to an issue, located
+// at the element if the error has no location of its own.
+func elementIssue(data []byte, offset int64, element string, err error) ConfigIssue {
+	issue := jsonIssue(data, offset, err)
+	if issue.Line == 0 {
+		issue = locatedIssue(data, offset, err)
+	}
+	issue.Message = element + ": " + issue.Message
+	return issue
+}
+
+func locatedIssue(data []byte, offset int64, err error) ConfigIssue {
+	line, column := lineColumn(data, offset)
+	return ConfigIssue{Line: line, Column: column, Message: err.Error()}
+}
+
+// Converts the byte offset to a 1-based line and column.
+func lineColumn(data []byte, offset int64) (int, int) {
+	if offset < 0 {
+		return 0, 0
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+	return line, utf8.RuneCount(before[lineStart:]) + 1
+}
+
+// Reports the top-level keys that appear more than once.
+func duplicateKeyIssues(data []byte) []ConfigIssue {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if _, err := decoder.Token(); err != nil {
+		return nil
+	}
+
+	var issues []ConfigIssue
+	seen := map[string]bool{}
+	for decoder.More() {
+		offset := skipSeparators(data, decoder.InputOffset())
+		token, err := decoder.Token()
+		if err != nil {
+			return issues
+		}
+		if key, ok := token.(string); ok {
+			if seen[key] {
+				issues = append(issues, locatedIssue(data, offset, fmt.Errorf("duplicate field %s", QuoteArg(key))))
+			}
+			seen[key] = true
+		}
+
+		var skip json.RawMessage
+		if err := decoder.Decode(&skip); err != nil {
+			return issues
+		}
+	}
+	return issues
+}
+
+// Finds the offsets of the elements of the top-level array with the key.
+func arrayElementOffsets(data []byte, key string) ([]int64, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if token != key {
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+			// null or an invalid value caught by the decoding
+			return nil, err
+		}
+
+		var offsets []int64
+		for decoder.More() {
+			offsets = append(offsets, skipSeparators(data, decoder.InputOffset()))
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return nil, err
+			}
+		}
+		return offsets, nil
+	}
+
+	return nil, nil
+}
+
+// Finds the offset of the first object key with the name after the start
+// offset, or -1.
+func keyOffset(data []byte, start int64, name string) int64 {
+	key, _ := json.Marshal(name)
+	for offset := int(start); ; {
+		index := bytes.Index(data[offset:], key)
+		if index < 0 {
+			return -1
+		}
+		offset += index
+		rest := bytes.TrimLeft(data[offset+len(key):], " \t\r\n")
+		if len(rest) > 0 && rest[0] == ':' {
+			return int64(offset)
+		}
+		offset += len(key)
+	}
+}
+
+// Skips the whitespace and commas before an array element.
+func skipSeparators(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}